@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/aduermael/crypto/ssh"
+	xssh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var (
+	// connection to the ssh-agent, opened on first use and
+	// re-opened when it stops working (ssh-agent restarted...)
+	sshAgent     agent.Agent
+	sshAgentConn net.Conn
+	sshAgentMu   sync.Mutex
+)
+
+// agentSigners returns signers for all keys held by the ssh-agent
+// listening on SSH_AUTH_SOCK. It returns no signers and no error
+// if SSH_AUTH_SOCK isn't set.
+func agentSigners() ([]ssh.Signer, error) {
+	sshAgentMu.Lock()
+	defer sshAgentMu.Unlock()
+
+	if sshAgent != nil {
+		xsigners, err := sshAgent.Signers()
+		if err == nil {
+			return convertAgentSigners(xsigners), nil
+		}
+		printDebug("ssh-agent connection lost, reconnecting:", err)
+		sshAgentConn.Close()
+		sshAgent = nil
+		sshAgentConn = nil
+	}
+
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		printDebug("SSH_AUTH_SOCK not set, ssh-agent not used")
+		return nil, nil
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to ssh-agent: %s", err)
+	}
+	client := agent.NewClient(conn)
+
+	xsigners, err := client.Signers()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("can't list ssh-agent keys: %s", err)
+	}
+	sshAgent = client
+	sshAgentConn = conn
+
+	return convertAgentSigners(xsigners), nil
+}
+
+// convertAgentSigners wraps signers from the agent package
+func convertAgentSigners(xsigners []xssh.Signer) []ssh.Signer {
+	signers := make([]ssh.Signer, 0, len(xsigners))
+	for _, xsigner := range xsigners {
+		pub, err := ssh.ParsePublicKey(xsigner.PublicKey().Marshal())
+		if err != nil {
+			printDebug("ignoring ssh-agent key:", err)
+			continue
+		}
+		signers = append(signers, &agentSigner{signer: xsigner, pub: pub})
+	}
+
+	printDebug("ssh-agent keys:", len(signers))
+
+	return signers
+}
+
+// agentSigner adapts a signer from the agent package, built on
+// golang.org/x/crypto/ssh, to the github.com/aduermael/crypto/ssh
+// fork used to establish connections.
+type agentSigner struct {
+	signer xssh.Signer
+	pub    ssh.PublicKey
+}
+
+func (s *agentSigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *agentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	sig, err := s.signer.Sign(rand, data)
+	if err != nil {
+		return nil, err
+	}
+	return &ssh.Signature{Format: sig.Format, Blob: sig.Blob}, nil
+}
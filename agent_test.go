@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/aduermael/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// testAgent is an in-process ssh-agent holding one key
+type testAgent struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func startTestAgent(t *testing.T, socket string) (*testAgent, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &testAgent{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			a.mu.Lock()
+			a.conns = append(a.conns, conn)
+			a.mu.Unlock()
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	return a, key
+}
+
+// stop closes the listener and all connections, like a killed agent
+func (a *testAgent) stop() {
+	a.ln.Close()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, conn := range a.conns {
+		conn.Close()
+	}
+}
+
+func TestAgentSignersAfterAgentRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "agent.sock")
+	defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+	os.Setenv("SSH_AUTH_SOCK", socket)
+
+	for i := 0; i < 2; i++ {
+		a, key := startTestAgent(t, socket)
+		signers, err := agentSigners()
+		if err != nil {
+			t.Fatalf("agent %d: %s", i, err)
+		}
+		if len(signers) != 1 {
+			t.Fatalf("agent %d: %d signers, 1 expected", i, len(signers))
+		}
+		pub, err := ssh.NewPublicKey(&key.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !keysEqual(signers[0].PublicKey(), pub) {
+			t.Errorf("agent %d: unexpected key", i)
+		}
+		a.stop()
+		os.Remove(socket)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aduermael/crypto/ssh"
+)
+
+const (
+	// larger than OpenSSH's 2MB so that bulk transfers (image
+	// pushes, build contexts) aren't limited by flow control
+	// on high latency links
+	sshChannelWindowSize = 8 << 20
+	sshChannelMaxPacket  = 64 << 10
+)
+
+// default algorithms, in preference order. AEAD ciphers come first:
+// AES-GCM is the fastest with AES instructions, chacha20-poly1305
+// without them. They don't need a separate MAC.
+var (
+	defaultCiphers = []string{
+		"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+		"chacha20-poly1305@openssh.com",
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+	}
+	defaultKexAlgorithms = []string{
+		"curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha1",
+	}
+	defaultMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha1",
+	}
+)
+
+// algorithms that can be enabled explicitly, in addition to defaults
+var (
+	supportedCiphers = append(defaultCiphers,
+		"aes128-cbc", "3des-cbc", "arcfour256", "arcfour128", "arcfour")
+	supportedKexAlgorithms = append(defaultKexAlgorithms,
+		"diffie-hellman-group1-sha1")
+	supportedMACs = append(defaultMACs,
+		"hmac-sha1-96")
+)
+
+// transportConfig returns ssh transport settings for target.
+// Flags have precedence over ssh config.
+func transportConfig(target *sshTarget) (ssh.Config, error) {
+	config := ssh.Config{
+		ChannelWindowSize: sshChannelWindowSize,
+		ChannelMaxPacket:  sshChannelMaxPacket,
+	}
+
+	var err error
+	config.Ciphers, err = algorithmList("cipher", sshCiphers, target.ciphers, defaultCiphers, supportedCiphers)
+	if err != nil {
+		return config, err
+	}
+	config.KeyExchanges, err = algorithmList("key exchange algorithm", sshKexAlgorithms, target.kexAlgorithms, defaultKexAlgorithms, supportedKexAlgorithms)
+	if err != nil {
+		return config, err
+	}
+	config.MACs, err = algorithmList("MAC", sshMACs, target.macs, defaultMACs, supportedMACs)
+	if err != nil {
+		return config, err
+	}
+
+	return config, nil
+}
+
+// algorithmList returns the algorithms set with a flag, or else in
+// ssh config. ssh config is shared with OpenSSH, that supports more
+// algorithms: unsupported ones are ignored there, unless none is left.
+func algorithmList(kind, flagList, configList string, defaults, supported []string) ([]string, error) {
+	if flagList != "" {
+		return parseAlgorithms(kind, flagList, defaults, supported)
+	}
+	list, err := supportedAlgorithms(kind, configList, supported)
+	if err != nil {
+		return nil, err
+	}
+	return parseAlgorithms(kind, list, defaults, supported)
+}
+
+// supportedAlgorithms removes unsupported algorithms from a list
+// found in ssh config, keeping its '+', '-' or '^' prefix
+func supportedAlgorithms(kind, list string, supported []string) (string, error) {
+	if list == "" {
+		return "", nil
+	}
+
+	op := ""
+	if list[0] == '+' || list[0] == '-' || list[0] == '^' {
+		op = list[:1]
+	}
+	// removing unsupported algorithms has no effect
+	if op == "-" {
+		return list, nil
+	}
+
+	names := make([]string, 0)
+	for _, name := range strings.Split(list[len(op):], ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !containsString(supported, name) {
+			printDebug("ignoring unsupported", kind, "from ssh config:", name)
+			continue
+		}
+		names = append(names, name)
+	}
+
+	// an empty list would mean defaults
+	if op == "" && len(names) == 0 {
+		return "", fmt.Errorf("no supported %s in ssh config: %s (supported: %s)", kind, list, strings.Join(supported, ","))
+	}
+	return op + strings.Join(names, ","), nil
+}
+
+// parseAlgorithms parses a comma separated list of algorithms, with the
+// same syntax as OpenSSH's Ciphers, KexAlgorithms and MACs options:
+// the list replaces defaults, unless it starts with '+' (appended
+// to defaults), '-' (removed from defaults, wildcards allowed)
+// or '^' (placed before defaults). Defaults are returned for
+// an empty list.
+func parseAlgorithms(kind, list string, defaults, supported []string) ([]string, error) {
+	if list == "" {
+		return defaults, nil
+	}
+
+	op := list[0]
+	if op == '+' || op == '-' || op == '^' {
+		list = list[1:]
+	}
+
+	names := make([]string, 0)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if op != '-' && !containsString(supported, name) {
+			return nil, fmt.Errorf("unsupported %s: %s (supported: %s)", kind, name, strings.Join(supported, ","))
+		}
+		names = append(names, name)
+	}
+
+	algorithms := make([]string, 0)
+	switch op {
+	case '+':
+		algorithms = append(algorithms, defaults...)
+		for _, name := range names {
+			if !containsString(algorithms, name) {
+				algorithms = append(algorithms, name)
+			}
+		}
+	case '-':
+		for _, algorithm := range defaults {
+			if !matchPatternList(names, algorithm) {
+				algorithms = append(algorithms, algorithm)
+			}
+		}
+	case '^':
+		algorithms = append(algorithms, names...)
+		for _, algorithm := range defaults {
+			if !containsString(algorithms, algorithm) {
+				algorithms = append(algorithms, algorithm)
+			}
+		}
+	default:
+		algorithms = names
+	}
+
+	if len(algorithms) == 0 {
+		return nil, fmt.Errorf("no %s left to negotiate", kind)
+	}
+	return algorithms, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aduermael/crypto/ssh"
+)
+
+func TestTransportConfigFromSSHConfig(t *testing.T) {
+	tests := []struct {
+		target  sshTarget
+		ciphers []string
+		kex     []string
+		macs    []string
+	}{
+		// hardened OpenSSH configs name algorithms that aren't supported
+		{
+			target: sshTarget{
+				ciphers:       "chacha20-poly1305@openssh.com,aes256-gcm@openssh.com,aes128-gcm@openssh.com",
+				kexAlgorithms: "curve25519-sha256,curve25519-sha256@libssh.org,diffie-hellman-group-exchange-sha256",
+				macs:          "hmac-sha2-512-etm@openssh.com,hmac-sha2-256-etm@openssh.com",
+			},
+			ciphers: []string{"chacha20-poly1305@openssh.com", "aes256-gcm@openssh.com", "aes128-gcm@openssh.com"},
+			kex:     []string{"curve25519-sha256@libssh.org"},
+			macs:    []string{"hmac-sha2-256-etm@openssh.com"},
+		},
+		{
+			target: sshTarget{
+				kexAlgorithms: "+diffie-hellman-group-exchange-sha1",
+				macs:          "-hmac-sha1*,umac-64@openssh.com",
+			},
+			ciphers: defaultCiphers,
+			kex:     defaultKexAlgorithms,
+			macs:    []string{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256"},
+		},
+	}
+
+	for i, test := range tests {
+		config, err := transportConfig(&test.target)
+		if err != nil {
+			t.Errorf("%d: %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(config.Ciphers, test.ciphers) {
+			t.Errorf("%d: ciphers %v, %v expected", i, config.Ciphers, test.ciphers)
+		}
+		if !reflect.DeepEqual(config.KeyExchanges, test.kex) {
+			t.Errorf("%d: key exchange algorithms %v, %v expected", i, config.KeyExchanges, test.kex)
+		}
+		if !reflect.DeepEqual(config.MACs, test.macs) {
+			t.Errorf("%d: MACs %v, %v expected", i, config.MACs, test.macs)
+		}
+	}
+
+	// nothing left to negotiate
+	if _, err := transportConfig(&sshTarget{macs: "hmac-sha2-512-etm@openssh.com,umac-128-etm@openssh.com"}); err == nil {
+		t.Error("no supported MAC in ssh config accepted")
+	}
+}
+
+func TestTransportConfigFlags(t *testing.T) {
+	defer func(ciphers string) {
+		sshCiphers = ciphers
+	}(sshCiphers)
+
+	// flags have precedence, and unsupported values are errors
+	sshCiphers = "aes128-ctr,aes512-ctr"
+	_, err := transportConfig(&sshTarget{ciphers: "aes128-gcm@openssh.com"})
+	if err == nil || !strings.Contains(err.Error(), "aes512-ctr") {
+		t.Errorf("unsupported cipher flag: %v", err)
+	}
+
+	sshCiphers = "aes128-ctr"
+	config, err := transportConfig(&sshTarget{ciphers: "aes128-gcm@openssh.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.Ciphers, []string{"aes128-ctr"}) {
+		t.Errorf("ciphers %v, [aes128-ctr] expected", config.Ciphers)
+	}
+}
+
+// BenchmarkCiphers measures throughput through a tunnel to an
+// in-process ssh server, for each preferred cipher
+func BenchmarkCiphers(b *testing.B) {
+	for _, cipher := range []string{"aes128-gcm@openssh.com", "chacha20-poly1305@openssh.com", "aes128-ctr"} {
+		b.Run(cipher, func(b *testing.B) {
+			benchmarkTunnel(b, 1, ssh.Config{
+				Ciphers:           []string{cipher},
+				ChannelWindowSize: sshChannelWindowSize,
+				ChannelMaxPacket:  sshChannelMaxPacket,
+			})
+		})
+	}
+}
+
+// BenchmarkChannelWindow compares the vendored ssh package's default
+// channel window and packet size with the ones docker-tunnel uses
+func BenchmarkChannelWindow(b *testing.B) {
+	b.Run("default", func(b *testing.B) {
+		benchmarkTunnel(b, 1, ssh.Config{})
+	})
+	b.Run("docker-tunnel", func(b *testing.B) {
+		benchmarkTunnel(b, 1, ssh.Config{
+			ChannelWindowSize: sshChannelWindowSize,
+			ChannelMaxPacket:  sshChannelMaxPacket,
+		})
+	})
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// requests waiting for their response on a connection, the
+	// Docker CLI sends one at a time but pipelining is allowed
+	auditMaxPendingRequests = 64
+)
+
+var (
+	// /v1.43/containers/json -> 1.43
+	reAPIVersion = regexp.MustCompile(`^/v([0-9]+\.[0-9]+)/`)
+
+	// Docker API requests log, nil if disabled (--audit-log)
+	auditLog *auditLogger
+)
+
+// auditEntry is one line of the audit log, written when a response
+// is done (or when the stream gets hijacked, for attach and exec)
+type auditEntry struct {
+	Time          time.Time `json:"time"`
+	Conn          uint64    `json:"conn"`
+	Client        string    `json:"client"`
+	ClientCert    string    `json:"client_cert,omitempty"`
+	SSH           string    `json:"ssh"`
+	Method        string    `json:"method"`
+	Path          string    `json:"path"`
+	Query         string    `json:"query,omitempty"`
+	APIVersion    string    `json:"api_version,omitempty"`
+	Status        int       `json:"status"`
+	DurationMs    float64   `json:"duration_ms"`
+	RequestBytes  int64     `json:"request_bytes"`
+	ResponseBytes int64     `json:"response_bytes"`
+	Hijacked      bool      `json:"hijacked,omitempty"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// auditLogger appends entries to a file, as JSON lines
+type auditLogger struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// openAuditLog opens path for appending, creating it if needed
+func openAuditLog(path string) (*auditLogger, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("can't open audit log: %s", err)
+	}
+	return &auditLogger{file: file}, nil
+}
+
+func (a *auditLogger) write(entry *auditEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// one write per entry, lines can't interleave
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		printError("can't write audit log:", err)
+	}
+}
+
+// auditRequest is a request waiting for its response
+type auditRequest struct {
+	entry   *auditEntry
+	method  string
+	upgrade bool
+	start   time.Time
+	// requestBytes is set before bodyRead gets closed
+	requestBytes int64
+	bodyRead     chan struct{}
+}
+
+// auditConn wraps the remote end of a proxied connection. A copy of
+// what goes through is parsed as HTTP requests and responses, to log
+// Docker API calls, while bytes are forwarded untouched. Parsing stops
+// for good when the stream gets hijacked (attach, exec...) or isn't
+// HTTP: the rest is only forwarded.
+type auditConn struct {
+	net.Conn
+	log      *logger
+	template auditEntry
+
+	requests  *io.PipeWriter
+	responses *io.PipeWriter
+	pending   chan *auditRequest
+	closeOnce sync.Once
+}
+
+// newAuditConn wraps remote, conn being the client end
+func newAuditConn(log *logger, id uint64, conn net.Conn, remote net.Conn, host *sshHost) *auditConn {
+	template := auditEntry{
+		Conn:   id,
+		Client: conn.RemoteAddr().Network() + "://" + conn.RemoteAddr().String(),
+		SSH:    host.destination,
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			template.ClientCert = certs[0].Subject.CommonName
+		}
+	}
+
+	requestsReader, requestsWriter := io.Pipe()
+	responsesReader, responsesWriter := io.Pipe()
+	c := &auditConn{
+		Conn:      remote,
+		log:       log,
+		template:  template,
+		requests:  requestsWriter,
+		responses: responsesWriter,
+		pending:   make(chan *auditRequest, auditMaxPendingRequests),
+	}
+	go c.parseRequests(requestsReader)
+	go c.parseResponses(responsesReader)
+	return c
+}
+
+// Write sends client data to the remote end, and to the request parser
+func (c *auditConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.requests.Write(b[:n])
+	}
+	return n, err
+}
+
+// Read receives data from the remote end, and sends it to the
+// response parser
+func (c *auditConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.responses.Write(b[:n])
+	}
+	if err != nil {
+		c.responses.Close()
+	}
+	return n, err
+}
+
+func (c *auditConn) CloseWrite() error {
+	c.requests.Close()
+	cw, ok := c.Conn.(closeWriter)
+	if !ok {
+		return fmt.Errorf("half-close not supported (%T)", c.Conn)
+	}
+	return cw.CloseWrite()
+}
+
+func (c *auditConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.requests.Close()
+		c.responses.Close()
+	})
+	return c.Conn.Close()
+}
+
+// parseRequests reads requests sent by the client. Once it's done,
+// the pipe is drained so that Write never blocks.
+func (c *auditConn) parseRequests(r *io.PipeReader) {
+	defer io.Copy(ioutil.Discard, r)
+	defer close(c.pending)
+
+	reader := bufio.NewReader(r)
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			if err != io.EOF {
+				c.log.warn("audit: can't parse request, not auditing connection anymore:", err)
+			}
+			return
+		}
+
+		entry := c.template
+		entry.Method = req.Method
+		entry.Path = req.URL.Path
+		entry.Query = req.URL.RawQuery
+		if match := reAPIVersion.FindStringSubmatch(req.URL.Path); match != nil {
+			entry.APIVersion = match[1]
+		}
+		pending := &auditRequest{
+			entry:    &entry,
+			method:   req.Method,
+			upgrade:  strings.EqualFold(req.Header.Get("Connection"), "upgrade"),
+			start:    time.Now(),
+			bodyRead: make(chan struct{}),
+		}
+		select {
+		case c.pending <- pending:
+		default:
+			c.log.warn("audit: too many pending requests, not auditing connection anymore")
+			return
+		}
+
+		n, err := io.Copy(ioutil.Discard, req.Body)
+		pending.requestBytes = n
+		close(pending.bodyRead)
+		if err != nil {
+			return
+		}
+		// what follows an upgrade request is the raw stream
+		if pending.upgrade {
+			return
+		}
+	}
+}
+
+// parseResponses reads responses sent by the remote Docker endpoint,
+// matches them with requests and writes audit entries. Once it's done,
+// the pipe is drained so that Read never blocks.
+func (c *auditConn) parseResponses(r *io.PipeReader) {
+	defer io.Copy(ioutil.Discard, r)
+
+	reader := bufio.NewReader(r)
+	for pending := range c.pending {
+		resp, err := readFinalResponse(reader, pending.method)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			c.finish(pending, 0, 0, false, fmt.Sprintf("no response: %s", err))
+			go c.abandon()
+			return
+		}
+
+		// 101 Switching Protocols, or 200 with a raw
+		// stream for daemons older than API 1.24
+		if resp.StatusCode == http.StatusSwitchingProtocols || pending.upgrade {
+			c.finish(pending, resp.StatusCode, 0, true, "")
+			return
+		}
+
+		n, err := io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		errorMessage := ""
+		if err != nil {
+			errorMessage = err.Error()
+		}
+		c.finish(pending, resp.StatusCode, n, false, errorMessage)
+		if err != nil {
+			go c.abandon()
+			return
+		}
+	}
+}
+
+// readFinalResponse reads a response, skipping informational ones
+// (100 Continue...) sent before it, except 101 Switching Protocols
+func readFinalResponse(reader *bufio.Reader, method string) (*http.Response, error) {
+	for {
+		resp, err := http.ReadResponse(reader, &http.Request{Method: method})
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode < 100 || resp.StatusCode >= 200 || resp.StatusCode == http.StatusSwitchingProtocols {
+			return resp, nil
+		}
+	}
+}
+
+// finish writes the audit entry of a request
+func (c *auditConn) finish(pending *auditRequest, status int, responseBytes int64, hijacked bool, errorMessage string) {
+	entry := pending.entry
+	// unknown if the response came before the end of the request
+	select {
+	case <-pending.bodyRead:
+		entry.RequestBytes = pending.requestBytes
+	default:
+	}
+	entry.Time = pending.start
+	entry.Status = status
+	entry.DurationMs = float64(time.Since(pending.start)) / float64(time.Millisecond)
+	entry.ResponseBytes = responseBytes
+	entry.Hijacked = hijacked
+	entry.Error = errorMessage
+	auditLog.write(entry)
+}
+
+// abandon logs requests that will never get a response
+func (c *auditConn) abandon() {
+	for pending := range c.pending {
+		c.finish(pending, 0, 0, false, "no response")
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// file names follow Docker conventions, so that the
+// directory can be used as DOCKER_CERT_PATH
+const (
+	caCertFile     = "ca.pem"
+	caKeyFile      = "ca-key.pem"
+	serverCertFile = "server-cert.pem"
+	serverKeyFile  = "server-key.pem"
+	clientCertFile = "cert.pem"
+	clientKeyFile  = "key.pem"
+)
+
+var (
+	// directory where certificates are generated
+	certsDir = ""
+	// hosts (names or IPs) the server certificate is valid for
+	certsHosts = []string{"localhost", "127.0.0.1", "::1"}
+	// certificates validity
+	certsDays = 365
+	// overwrite existing files
+	certsForce = false
+)
+
+func newCertsCommand() *cobra.Command {
+	certsCmd := &cobra.Command{
+		Use:   "certs",
+		Short: "Manage TLS certificates for proxy mode",
+	}
+
+	generateCmd := &cobra.Command{
+		Use:   "generate",
+		Short: "Generate a CA, a server certificate and a client certificate",
+		Run: func(cmd *cobra.Command, args []string) {
+			dir := certsDir
+			if dir == "" {
+				var err error
+				dir, err = defaultCertsDir()
+				if err != nil {
+					printFatal(err)
+				}
+			}
+
+			if err := generateCerts(dir, certsHosts, certsDays, certsForce); err != nil {
+				printFatal(err)
+			}
+
+			fmt.Println("certificates generated in " + dir)
+			fmt.Println("start the proxy with --tlsverify, then use it with:")
+			fmt.Println("export DOCKER_HOST=tcp://127.0.0.1:2376 DOCKER_TLS_VERIFY=1 DOCKER_CERT_PATH=" + dir)
+		},
+	}
+
+	generateCmd.Flags().StringVar(&certsDir, "dir", "", "output directory (default ~/.docker-tunnel/certs)")
+	generateCmd.Flags().StringArrayVar(&certsHosts, "host", certsHosts, "host name or IP the server certificate is valid for (can be repeated)")
+	generateCmd.Flags().IntVar(&certsDays, "days", certsDays, "number of days certificates are valid")
+	generateCmd.Flags().BoolVarP(&certsForce, "force", "f", false, "overwrite existing certificates")
+	generateCmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "verbose mode (debug logs)")
+
+	certsCmd.AddCommand(generateCmd)
+
+	return certsCmd
+}
+
+// generateCerts creates a local CA, then a server and a client
+// certificate signed by it, in dir
+func generateCerts(dir string, hosts []string, days int, force bool) error {
+	if days < 1 {
+		return fmt.Errorf("invalid number of days: %d", days)
+	}
+
+	files := []string{caCertFile, caKeyFile, serverCertFile, serverKeyFile, clientCertFile, clientKeyFile}
+	if !force {
+		for _, file := range files {
+			if _, err := os.Stat(filepath.Join(dir, file)); err == nil {
+				return fmt.Errorf("%s already exists (use --force to overwrite)", filepath.Join(dir, file))
+			}
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	notBefore := time.Now().Add(-time.Hour)
+	notAfter := notBefore.Add(time.Duration(days) * 24 * time.Hour)
+
+	// CA
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	caTemplate, err := certTemplate("docker-tunnel CA", notBefore, notAfter)
+	if err != nil {
+		return err
+	}
+	caTemplate.IsCA = true
+	caTemplate.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return err
+	}
+
+	// server
+	serverTemplate, err := certTemplate("docker-tunnel server", notBefore, notAfter)
+	if err != nil {
+		return err
+	}
+	serverTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			serverTemplate.IPAddresses = append(serverTemplate.IPAddresses, ip)
+		} else {
+			serverTemplate.DNSNames = append(serverTemplate.DNSNames, host)
+		}
+	}
+	serverKey, serverDER, err := signedCert(serverTemplate, caCert, caKey)
+	if err != nil {
+		return err
+	}
+
+	// client
+	clientTemplate, err := certTemplate("docker-tunnel client", notBefore, notAfter)
+	if err != nil {
+		return err
+	}
+	clientTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	clientKey, clientDER, err := signedCert(clientTemplate, caCert, caKey)
+	if err != nil {
+		return err
+	}
+
+	if err := writeCert(filepath.Join(dir, caCertFile), caDER); err != nil {
+		return err
+	}
+	if err := writeKey(filepath.Join(dir, caKeyFile), caKey); err != nil {
+		return err
+	}
+	if err := writeCert(filepath.Join(dir, serverCertFile), serverDER); err != nil {
+		return err
+	}
+	if err := writeKey(filepath.Join(dir, serverKeyFile), serverKey); err != nil {
+		return err
+	}
+	if err := writeCert(filepath.Join(dir, clientCertFile), clientDER); err != nil {
+		return err
+	}
+	return writeKey(filepath.Join(dir, clientKeyFile), clientKey)
+}
+
+// certTemplate returns a certificate template with a random serial number
+func certTemplate(commonName string, notBefore, notAfter time.Time) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	return &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		BasicConstraintsValid: true,
+	}, nil
+}
+
+// signedCert generates a key and returns it along with a
+// DER encoded certificate for it, signed by the CA
+func signedCert(template, caCert *x509.Certificate, caKey *ecdsa.PrivateKey) (*ecdsa.PrivateKey, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, der, nil
+}
+
+func writeCert(path string, der []byte) error {
+	printDebug("writing", path)
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+func writeKey(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	printDebug("writing", path)
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// addConnectionFlags adds flags used to establish the tunnel
+func addConnectionFlags(flags *pflag.FlagSet) {
+	flags.StringArrayVarP(&sshIdentityFiles, "sshid", "i", []string{}, "path to private key (can be repeated)")
+	flags.StringVarP(&sshConfigFile, "config", "F", "", "path to ssh config file (default ~/.ssh/config, \"none\" to ignore)")
+	flags.StringVarP(&proxyJump, "jump", "J", "", "connect through jump hosts ([user@]host[:port][,[user@]host[:port]...])")
+	flags.BoolVar(&noAgent, "no-agent", false, "don't authenticate with ssh-agent keys (SSH_AUTH_SOCK)")
+	flags.StringVarP(&remoteDockerAddr, "remote", "r", "", "remote Docker endpoint, unix:///path or tcp://host:port (detected by default)")
+	flags.IntVar(&serverAliveInterval, "server-alive-interval", int(defaultServerAliveInterval/time.Second), "seconds between keepalive requests, 0 to disable (overrides ssh config)")
+	flags.IntVar(&serverAliveCountMax, "server-alive-count-max", defaultServerAliveCountMax, "missed keepalive replies before reconnecting (overrides ssh config)")
+	flags.StringVar(&transportMode, "transport", transportAuto, "how to reach the remote Docker endpoint: auto, direct (ssh channels), dial-stdio (docker system dial-stdio) or socat")
+	flags.IntVar(&poolSize, "pool-size", 1, "number of ssh connections to spread Docker connections over")
+	flags.DurationVar(&idleTimeout, "idle-timeout", 0, "close Docker connections idle for that long, in both directions (0 disables)")
+	flags.StringVar(&sshCiphers, "ciphers", "", "ssh ciphers, in preference order (OpenSSH syntax, \"+\", \"-\" or \"^\" prefix modifies defaults)")
+	flags.StringVar(&sshKexAlgorithms, "kex", "", "ssh key exchange algorithms (same syntax as --ciphers)")
+	flags.StringVar(&sshMACs, "macs", "", "ssh MAC algorithms (same syntax as --ciphers)")
+	flags.StringVar(&strictHostKeyChecking, "strict-host-key-checking", hostKeyCheckingAsk, "unknown host keys policy (yes, ask or accept-new)")
+}
+
+// addLogFlags adds logging flags
+func addLogFlags(flags *pflag.FlagSet) {
+	flags.BoolVarP(&verbose, "verbose", "v", false, "verbose mode (debug logs, same as --log-level debug)")
+	flags.StringVar(&logLevelName, "log-level", "info", "minimum level of logged messages: debug, info, warn or error")
+	flags.StringVar(&logFormatName, "log-format", logFormatText, "log format: text or json")
+	flags.StringVar(&logFilePath, "log-file", "", "append logs to that file instead of stderr")
+}
+
+// addAuditFlags adds the audit log flag, for commands proxying
+// connections (Docker API requests can't be told apart otherwise)
+func addAuditFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&auditLogPath, "audit-log", "", "append Docker API requests to that file (JSON lines)")
+}
+
+// addShellFlags adds shell mode flags
+func addShellFlags(flags *pflag.FlagSet) {
+	flags.StringVarP(&shell, "shell", "s", "bash", "shell to open session")
+}
+
+// addProxyFlags adds proxy mode flags
+func addProxyFlags(flags *pflag.FlagSet) {
+	flags.StringArrayVarP(&listenAddrs, "listen", "l", []string{defaultListenAddr}, "listen address, tcp://[host]:port (port 0 picks one) or unix:///path (can be repeated)")
+	flags.BoolVar(&tlsEnabled, "tls", false, "serve TLS on tcp listeners (default port 2376)")
+	flags.BoolVar(&tlsVerify, "tlsverify", false, "serve TLS and require client certificates signed by the CA (implies --tls)")
+	flags.StringVar(&tlsCACert, "tlscacert", "", "CA certificate used to verify clients (default ~/.docker-tunnel/certs/ca.pem)")
+	flags.StringVar(&tlsCert, "tlscert", "", "server certificate (default ~/.docker-tunnel/certs/server-cert.pem)")
+	flags.StringVar(&tlsKey, "tlskey", "", "server private key (default ~/.docker-tunnel/certs/server-key.pem)")
+	flags.DurationVar(&shutdownTimeout, "shutdown-timeout", defaultShutdownTimeout, "how long active Docker connections are waited for when interrupted or terminated")
+}
+
+// newConnectCommand returns the default command, used when
+// docker-tunnel is given a host instead of a command name
+func newConnectCommand(use string) *cobra.Command {
+	connectCmd := &cobra.Command{
+		Use:   use,
+		Short: "Open a shell session connected to the remote Docker host (default command)",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) != 1 {
+				cmd.Usage()
+				return
+			}
+			pool, remoteAddr := connectTunnel(cmd, args[0])
+			defer pool.Close()
+
+			if proxyMode {
+				runProxy(cmd, pool, remoteAddr)
+				return
+			}
+			runShell(tunnelName(args[0]), pool, remoteAddr)
+		},
+	}
+
+	addConnectionFlags(connectCmd.Flags())
+	addLogFlags(connectCmd.Flags())
+	addAuditFlags(connectCmd.Flags())
+	addShellFlags(connectCmd.Flags())
+	addProxyFlags(connectCmd.Flags())
+	connectCmd.Flags().BoolVarP(&proxyMode, "proxy", "p", false, "proxy mode (don't start shell session)")
+	connectCmd.Flags().MarkDeprecated("proxy", "use \"docker-tunnel proxy\" instead")
+
+	return connectCmd
+}
+
+func newShellCommand() *cobra.Command {
+	shellCmd := &cobra.Command{
+		Use:   "shell [user@]host",
+		Short: "Open a shell session connected to the remote Docker host",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) != 1 {
+				cmd.Usage()
+				return
+			}
+			pool, remoteAddr := connectTunnel(cmd, args[0])
+			defer pool.Close()
+
+			runShell(tunnelName(args[0]), pool, remoteAddr)
+		},
+	}
+
+	addConnectionFlags(shellCmd.Flags())
+	addLogFlags(shellCmd.Flags())
+	addAuditFlags(shellCmd.Flags())
+	addShellFlags(shellCmd.Flags())
+
+	return shellCmd
+}
+
+func newProxyCommand() *cobra.Command {
+	proxyCmd := &cobra.Command{
+		Use:   "proxy [user@]host",
+		Short: "Expose the remote Docker API locally",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) != 1 {
+				cmd.Usage()
+				return
+			}
+			pool, remoteAddr := connectTunnel(cmd, args[0])
+			defer pool.Close()
+
+			runProxy(cmd, pool, remoteAddr)
+		},
+	}
+
+	addConnectionFlags(proxyCmd.Flags())
+	addLogFlags(proxyCmd.Flags())
+	addAuditFlags(proxyCmd.Flags())
+	addProxyFlags(proxyCmd.Flags())
+
+	return proxyCmd
+}
+
+func newExecCommand() *cobra.Command {
+	execCmd := &cobra.Command{
+		Use:   "exec [user@]host [--] command [args...]",
+		Short: "Run a command with DOCKER_HOST pointing to the remote Docker host",
+		Run: func(cmd *cobra.Command, args []string) {
+			// flags are only parsed before host, so
+			// "--" between host and command is optional
+			if len(args) > 1 && args[1] == "--" {
+				args = append(args[:1], args[2:]...)
+			}
+			if len(args) < 2 {
+				cmd.Usage()
+				return
+			}
+			pool, remoteAddr := connectTunnel(cmd, args[0])
+
+			status := runExec(tunnelName(args[0]), pool, remoteAddr, args[1:])
+			pool.Close()
+			os.Exit(status)
+		},
+	}
+
+	addConnectionFlags(execCmd.Flags())
+	addLogFlags(execCmd.Flags())
+	addAuditFlags(execCmd.Flags())
+	// command flags are not docker-tunnel flags
+	execCmd.Flags().SetInterspersed(false)
+
+	return execCmd
+}
+
+func newStatusCommand() *cobra.Command {
+	statusCmd := &cobra.Command{
+		Use:   "status name|[user@]host",
+		Short: "Show background tunnel status, or check the remote Docker daemon can be reached",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) != 1 {
+				cmd.Usage()
+				return
+			}
+
+			// background tunnels report their own status,
+			// otherwise a connection is established to check
+			if response, err := callControl(tunnelName(args[0]), controlStatus); err == nil {
+				printTunnelStatus(response.Status)
+				return
+			}
+
+			pool, remoteAddr := connectTunnel(cmd, args[0])
+			defer pool.Close()
+
+			if err := runStatus(args[0], pool, remoteAddr); err != nil {
+				printFatal(err)
+			}
+		},
+	}
+
+	addConnectionFlags(statusCmd.Flags())
+	addLogFlags(statusCmd.Flags())
+
+	return statusCmd
+}
+
+// connectTunnel establishes ssh connections to userAtHost
+// and returns them along with the remote Docker endpoint
+func connectTunnel(cmd *cobra.Command, userAtHost string) (*sshPool, string) {
+	if err := checkTransport(transportMode); err != nil {
+		printFatal(err)
+	}
+
+	aliveInterval, aliveCountMax, err := keepAliveSettings(cmd, userAtHost)
+	if err != nil {
+		printFatal(err)
+	}
+
+	if auditLogPath != "" {
+		auditLog, err = openAuditLog(auditLogPath)
+		if err != nil {
+			printFatal(err)
+		}
+	}
+
+	// connections are re-established if they drop
+	pool, err := newSSHPool(poolSize, func() (*sshHost, error) {
+		return sshConnect(userAtHost, sshIdentityFiles)
+	}, aliveInterval, aliveCountMax)
+	if err != nil {
+		printFatal(err)
+	}
+
+	remoteAddr := remoteDockerAddr
+	if remoteAddr == "" {
+		if client, release, err := pool.Client(); err == nil {
+			remoteAddr = detectRemoteDockerAddr(client.Client)
+			release()
+		}
+	}
+	if _, _, err := parseRemoteAddr(remoteAddr); err != nil {
+		pool.Close()
+		printFatal(err)
+	}
+	printDebug("remote Docker endpoint:", remoteAddr)
+
+	return pool, remoteAddr
+}
+
+// runProxy serves the remote Docker API on listen addresses until
+// docker-tunnel is interrupted or terminated, then waits for
+// proxied streams to finish
+func runProxy(cmd *cobra.Command, pool *sshPool, remoteAddr string) {
+	printDebug("proxy mode")
+
+	signals := shutdownSignals()
+
+	listeners, err := proxyListeners(cmd)
+	if err != nil {
+		printFatal(err)
+	}
+	for _, ln := range listeners {
+		print("listening on " + listenerURL(ln) + "...")
+		startServing(ln, pool, remoteAddr)
+	}
+
+	sig := <-signals
+	print("shutting down:", sig)
+	drain(listeners, shutdownTimeout, signals)
+}
+
+// proxyListeners listens on proxy mode addresses (--listen, --tls...)
+func proxyListeners(cmd *cobra.Command) ([]net.Listener, error) {
+	var tlsConfig *tls.Config
+	if tlsEnabled || tlsVerify {
+		var err error
+		tlsConfig, err = serverTLSConfig(tlsCACert, tlsCert, tlsKey, tlsVerify)
+		if err != nil {
+			return nil, err
+		}
+		if !cmd.Flags().Changed("listen") {
+			listenAddrs = []string{defaultTLSListenAddr}
+		}
+	}
+
+	listeners := make([]net.Listener, 0, len(listenAddrs))
+	for _, listenAddr := range listenAddrs {
+		ln, err := listen(listenAddr)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return nil, err
+		}
+		if tlsConfig != nil {
+			ln = tlsListener(ln, tlsConfig)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// runShell opens a shell session, connected to remote Docker host.
+// Unlike the proxy, it doesn't drain streams when interrupted: Docker
+// clients run in the shell, which gets SIGHUP and ends with them.
+func runShell(name string, pool *sshPool, remoteAddr string) {
+	printDebug("shell mode")
+
+	socketPath, ln := listenSessionSocket(name)
+	defer os.Remove(socketPath)
+	addExitHook(func() {
+		os.Remove(socketPath)
+	})
+
+	// listen in background
+	startServing(ln, pool, remoteAddr)
+
+	os.Setenv("PS1", "🐳  $ ")
+	os.Setenv("DOCKER_HOST", "unix://"+socketPath)
+
+	sh := exec.Command(shell)
+	sh.Stdout = os.Stdout
+	sh.Stderr = os.Stderr
+	sh.Stdin = os.Stdin
+
+	if err := sh.Start(); err != nil {
+		printFatal(err)
+	}
+	// the shell would be left without Docker host
+	addExitHook(func() {
+		sh.Process.Signal(syscall.SIGHUP)
+	})
+	exitOnSignals()
+
+	_ = sh.Wait()
+}
+
+// listenSessionSocket listens on the unix socket of a shell or exec
+// session: <name>-<pid>.sock, in the sessions subdirectory of the
+// runtime directory. Sessions never use the socket of a background
+// tunnel (<name>.sock), which Docker contexts may point to.
+func listenSessionSocket(name string) (string, net.Listener) {
+	dir, err := runtimeDir()
+	if err != nil {
+		printFatal(err)
+	}
+	dir = filepath.Join(dir, "sessions")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		printFatal(fmt.Errorf("can't create sessions directory: %s", err))
+	}
+
+	// sockets left by sessions that got killed
+	if paths, err := filepath.Glob(filepath.Join(dir, "*.sock")); err == nil {
+		for _, path := range paths {
+			removeStaleSocket(path)
+		}
+	}
+
+	socketPath := filepath.Join(dir, name+"-"+strconv.Itoa(os.Getpid())+".sock")
+	ln, err := listen("unix://" + socketPath)
+	if err != nil {
+		printFatal(err)
+	}
+	printDebug("socket path:", socketPath)
+	return socketPath, ln
+}
+
+// dockerVersion is the part of the Docker API /version response
+// reported by the status command
+type dockerVersion struct {
+	Version    string
+	APIVersion string `json:"ApiVersion"`
+	Os         string
+	Arch       string
+}
+
+// runStatus prints information about the ssh connection,
+// and queries the remote Docker daemon version
+func runStatus(userAtHost string, pool *sshPool, remoteAddr string) error {
+	host, release, err := pool.Client()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	network, addr, err := parseRemoteAddr(remoteAddr)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(string, string) (net.Conn, error) {
+				return host.dialDocker(rootLogger, network, addr)
+			},
+		},
+		Timeout: 30 * time.Second,
+	}
+
+	start := time.Now()
+	resp, err := client.Get("http://docker/version")
+	if err != nil {
+		return fmt.Errorf("can't reach remote Docker daemon: %s", err)
+	}
+	defer resp.Body.Close()
+	latency := time.Since(start)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("remote Docker daemon replied: %s", resp.Status)
+	}
+	var version dockerVersion
+	if err := json.NewDecoder(resp.Body).Decode(&version); err != nil {
+		return fmt.Errorf("can't read remote Docker daemon version: %s", err)
+	}
+
+	fmt.Printf("host:             %s (%s)\n", userAtHost, host.RemoteAddr())
+	fmt.Printf("ssh server:       %s\n", host.ServerVersion())
+	fmt.Printf("Docker endpoint:  %s\n", remoteAddr)
+	fmt.Printf("Docker version:   %s (API %s, %s/%s)\n", version.Version, version.APIVersion, version.Os, version.Arch)
+	fmt.Printf("latency:          %s\n", latency/time.Millisecond*time.Millisecond)
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSessionSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runtime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("XDG_RUNTIME_DIR", os.Getenv("XDG_RUNTIME_DIR"))
+	os.Setenv("XDG_RUNTIME_DIR", dir)
+	sessionsDir := filepath.Join(dir, "docker-tunnel", "sessions")
+
+	tunnelSocket, err := tunnelFile("prod", ".sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	socketPath, ln := listenSessionSocket("prod")
+	if filepath.Dir(socketPath) != sessionsDir {
+		t.Errorf("session socket %s isn't in the sessions directory", socketPath)
+	}
+
+	// a background tunnel can still be started while the session runs
+	tunnelLn, err := listen("unix://" + tunnelSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnelLn.Close()
+	ln.Close()
+
+	// socket left by a session that got killed
+	stalePath := filepath.Join(sessionsDir, "prod-1.sock")
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: stalePath, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	_, ln = listenSessionSocket("prod")
+	defer ln.Close()
+	if _, err := os.Lstat(stalePath); !os.IsNotExist(err) {
+		t.Errorf("stale session socket not removed: %v", err)
+	}
+}
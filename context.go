@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	// names accepted by the Docker CLI for contexts
+	reContextName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.+-]+$`)
+)
+
+// dockerContext is the metadata of a Docker CLI context
+// (~/.docker/contexts/meta/<sha256 of name>/meta.json)
+type dockerContext struct {
+	Name      string
+	Metadata  dockerContextMetadata
+	Endpoints map[string]dockerContextEndpoint
+}
+
+type dockerContextMetadata struct {
+	Description string `json:",omitempty"`
+}
+
+type dockerContextEndpoint struct {
+	Host          string
+	SkipTLSVerify bool
+}
+
+func newContextCommand() *cobra.Command {
+	contextCmd := &cobra.Command{
+		Use:   "context",
+		Short: "Manage Docker CLI contexts for background tunnels",
+	}
+
+	var name string
+	installCmd := &cobra.Command{
+		Use:   "install [user@]host",
+		Short: "Start a background tunnel and create a Docker CLI context using it",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) != 1 {
+				cmd.Usage()
+				return
+			}
+			if name == "" {
+				name = tunnelName(args[0])
+			}
+			if !reContextName.MatchString(name) {
+				printFatal(fmt.Sprintf("invalid context name: %s (use --name)", name))
+			}
+
+			var status *tunnelStatus
+			if response, err := callControl(name, controlStatus); err == nil {
+				status = response.Status
+			} else {
+				// same flags, given to "up"
+				status, err = startDaemon(name, append([]string{"up"}, withoutWords(os.Args[1:], "context", "install")...))
+				if err != nil {
+					printFatal(err)
+				}
+				fmt.Println("tunnel " + name + " is up (pid " + fmt.Sprint(status.Pid) + ")")
+			}
+
+			dockerHost, err := contextDockerHost(status)
+			if err != nil {
+				printFatal(err)
+			}
+			if err := installDockerContext(name, args[0], dockerHost); err != nil {
+				printFatal(err)
+			}
+			fmt.Println("context " + name + " installed, use it with:")
+			fmt.Println("docker --context " + name + " ps")
+		},
+	}
+	addConnectionFlags(installCmd.Flags())
+	addLogFlags(installCmd.Flags())
+	addAuditFlags(installCmd.Flags())
+	installCmd.Flags().StringVar(&name, "name", "", "tunnel and context name (default derived from host)")
+
+	removeCmd := &cobra.Command{
+		Use:   "remove name|[user@]host",
+		Short: "Remove a Docker CLI context and stop its background tunnel",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) != 1 {
+				cmd.Usage()
+				return
+			}
+			name := tunnelName(args[0])
+
+			if err := removeDockerContext(name); err != nil {
+				printFatal(err)
+			}
+			fmt.Println("context " + name + " removed")
+
+			if err := stopDaemon(name); err == nil {
+				fmt.Println("tunnel " + name + " is down")
+			} else if err != errTunnelNotUp {
+				printError(name+":", err)
+			}
+		},
+	}
+
+	contextCmd.AddCommand(installCmd, removeCmd)
+
+	return contextCmd
+}
+
+// contextDockerHost returns the unix socket a tunnel listens on.
+// Contexts have no TLS settings, and tcp listeners are reachable by
+// other users: tunnels started with --listen or --tls can't be used.
+func contextDockerHost(status *tunnelStatus) (string, error) {
+	for _, addr := range status.Listen {
+		if strings.HasPrefix(addr, "unix://") {
+			return addr, nil
+		}
+	}
+	return "", fmt.Errorf("tunnel %s doesn't listen on a unix socket (%s), restart it without --listen and --tls",
+		status.Name, strings.Join(status.Listen, ", "))
+}
+
+// dockerConfigDir returns the Docker CLI configuration
+// directory: $DOCKER_CONFIG or ~/.docker
+func dockerConfigDir() (string, error) {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir, nil
+	}
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(usr.HomeDir, ".docker"), nil
+}
+
+// dockerContextDir returns the directory where
+// the Docker CLI stores a context's metadata
+func dockerContextDir(name string) (string, error) {
+	configDir, err := dockerConfigDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(name))
+	return filepath.Join(configDir, "contexts", "meta", hex.EncodeToString(sum[:])), nil
+}
+
+// installDockerContext creates or updates a Docker CLI context
+// with dockerHost as Docker endpoint
+func installDockerContext(name, host, dockerHost string) error {
+	dir, err := dockerContextDir(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("can't create context directory: %s", err)
+	}
+
+	content, err := json.Marshal(&dockerContext{
+		Name:     name,
+		Metadata: dockerContextMetadata{Description: "docker-tunnel to " + host},
+		Endpoints: map[string]dockerContextEndpoint{
+			"docker": {Host: dockerHost},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	printDebug("writing context:", filepath.Join(dir, "meta.json"))
+	return ioutil.WriteFile(filepath.Join(dir, "meta.json"), content, 0644)
+}
+
+// removeDockerContext removes a Docker CLI context. If it's the current
+// context, the Docker CLI is switched back to the default one.
+func removeDockerContext(name string) error {
+	dir, err := dockerContextDir(name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(dir, "meta.json")); err != nil {
+		return fmt.Errorf("context %s not found", name)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+
+	configDir, err := dockerConfigDir()
+	if err != nil {
+		return err
+	}
+	configPath := filepath.Join(configDir, "config.json")
+	content, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil
+	}
+	// other fields are kept as they are
+	config := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(content, &config); err != nil {
+		return fmt.Errorf("can't parse %s: %s", configPath, err)
+	}
+	var current string
+	if json.Unmarshal(config["currentContext"], &current) != nil || current != name {
+		return nil
+	}
+	delete(config, "currentContext")
+	if content, err = json.MarshalIndent(config, "", "\t"); err != nil {
+		return err
+	}
+	print("current context was " + name + ", switched back to default")
+	return ioutil.WriteFile(configPath, content, 0600)
+}
+
+// withoutWords returns args without the first occurrence of each word
+func withoutWords(args []string, words ...string) []string {
+	result := make([]string, 0, len(args))
+	for _, arg := range args {
+		if len(words) > 0 && arg == words[0] {
+			words = words[1:]
+			continue
+		}
+		result = append(result, arg)
+	}
+	return result
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	// set in the environment of the background process started by "up"
+	daemonEnv = "DOCKER_TUNNEL_DAEMON"
+	// how long "down" waits for a background tunnel to exit,
+	// in addition to its shutdown timeout
+	daemonStopTimeout = 10 * time.Second
+	// control socket dial and request timeout
+	controlTimeout = 5 * time.Second
+	// how long "up" waits for a background tunnel to be connected
+	// (ssh handshakes through jump hosts have no timeout of their own)
+	daemonStartTimeout = time.Minute
+	// log lines shown when a background tunnel fails to start
+	daemonLogTailLines = 10
+)
+
+var (
+	// characters replaced in tunnel names, '@' as well since names
+	// are used for Docker CLI contexts, which reject it
+	reUnsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+	errTunnelNotUp = errors.New("tunnel isn't up")
+)
+
+// commands accepted on control sockets
+const (
+	controlStatus = "status"
+	controlStop   = "stop"
+)
+
+// controlRequest is sent to a background tunnel's control socket,
+// one JSON object per connection
+type controlRequest struct {
+	Command string `json:"command"`
+}
+
+// controlResponse is the reply to a controlRequest
+type controlResponse struct {
+	Error  string        `json:"error,omitempty"`
+	Status *tunnelStatus `json:"status,omitempty"`
+}
+
+// tunnelStatus describes a background tunnel
+type tunnelStatus struct {
+	Name           string    `json:"name"`
+	Host           string    `json:"host"`
+	Pid            int       `json:"pid"`
+	Started        time.Time `json:"started"`
+	Listen         []string  `json:"listen"`
+	RemoteAddr     string    `json:"remote_addr"`
+	SSHConnections []string  `json:"ssh_connections"`
+	ActiveStreams  int64     `json:"active_streams"`
+	TotalStreams   uint64    `json:"total_streams"`
+	StreamErrors   uint64    `json:"stream_errors"`
+	BytesSent      uint64    `json:"bytes_sent"`
+	BytesReceived  uint64    `json:"bytes_received"`
+	// streams are waited for that long when stopping
+	ShutdownTimeout time.Duration `json:"shutdown_timeout"`
+}
+
+// runtimeDir returns the directory where background tunnels keep
+// control sockets, pidfiles and logs: $XDG_RUNTIME_DIR/docker-tunnel,
+// or a per-user directory in the temp directory. It's created if
+// needed, and only accessible to the current user.
+func runtimeDir() (string, error) {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir != "" {
+		dir = filepath.Join(dir, "docker-tunnel")
+	} else {
+		dir = filepath.Join(os.TempDir(), "docker-tunnel-"+strconv.Itoa(os.Getuid()))
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("can't create runtime directory: %s", err)
+	}
+	// the temp directory is shared, make sure
+	// nobody else created the directory first
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return "", fmt.Errorf("can't create runtime directory: %s", err)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); !info.IsDir() || (ok && int(stat.Uid) != os.Getuid()) {
+		return "", fmt.Errorf("runtime directory %s isn't owned by current user", dir)
+	}
+	if info.Mode().Perm() != 0700 {
+		if err := os.Chmod(dir, 0700); err != nil {
+			return "", fmt.Errorf("can't restrict runtime directory permissions: %s", err)
+		}
+	}
+	return dir, nil
+}
+
+// tunnelName returns the name of the tunnel to host, usable in file names
+func tunnelName(host string) string {
+	return strings.Trim(reUnsafeNameChars.ReplaceAllString(host, "_"), "._")
+}
+
+// tunnelFile returns the path of a background tunnel file
+// in the runtime directory, ext being ".sock", ".ctl", ".pid"...
+func tunnelFile(name, ext string) (string, error) {
+	dir, err := runtimeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name+ext), nil
+}
+
+func newUpCommand() *cobra.Command {
+	var name string
+
+	upCmd := &cobra.Command{
+		Use:   "up [user@]host",
+		Short: "Start a tunnel in the background",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) != 1 {
+				cmd.Usage()
+				return
+			}
+			if name == "" {
+				name = tunnelName(args[0])
+			}
+
+			if !cmd.Flags().Changed("listen") && !tlsEnabled && !tlsVerify {
+				socketPath, err := tunnelFile(name, ".sock")
+				if err != nil {
+					printFatal(err)
+				}
+				listenAddrs = []string{"unix://" + socketPath}
+			}
+
+			if os.Getenv(daemonEnv) != "" {
+				runDaemon(cmd, args[0], name)
+				return
+			}
+
+			status, err := startDaemon(name, os.Args[1:])
+			if err != nil {
+				printFatal(err)
+			}
+			fmt.Println("tunnel " + name + " is up (pid " + strconv.Itoa(status.Pid) + ")")
+			for _, listenAddr := range status.Listen {
+				fmt.Println("export DOCKER_HOST=" + listenAddr)
+			}
+		},
+	}
+
+	addConnectionFlags(upCmd.Flags())
+	addLogFlags(upCmd.Flags())
+	addAuditFlags(upCmd.Flags())
+	addProxyFlags(upCmd.Flags())
+	upCmd.Flags().Lookup("listen").DefValue = "[unix://$XDG_RUNTIME_DIR/docker-tunnel/<name>.sock]"
+	upCmd.Flags().StringVar(&name, "name", "", "tunnel name (default derived from host)")
+
+	return upCmd
+}
+
+func newDownCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "down name|[user@]host",
+		Short: "Stop a background tunnel",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) != 1 {
+				cmd.Usage()
+				return
+			}
+			name := tunnelName(args[0])
+
+			if err := stopDaemon(name); err != nil {
+				printFatal(name+":", err)
+			}
+			fmt.Println("tunnel " + name + " is down")
+		},
+	}
+}
+
+func newLsCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "ls",
+		Short: "List background tunnels",
+		Run: func(cmd *cobra.Command, args []string) {
+			statuses, err := listDaemons()
+			if err != nil {
+				printFatal(err)
+			}
+
+			fmt.Printf("%-20s %-8s %-12s %-16s %-24s %s\n", "NAME", "PID", "UPTIME", "STREAMS", "SENT / RECEIVED", "DOCKER_HOST")
+			for _, status := range statuses {
+				fmt.Printf("%-20s %-8d %-12s %-16s %-24s %s\n",
+					status.Name,
+					status.Pid,
+					formatUptime(status.Started),
+					fmt.Sprintf("%d (%d total)", status.ActiveStreams, status.TotalStreams),
+					formatBytes(status.BytesSent)+" / "+formatBytes(status.BytesReceived),
+					strings.Join(status.Listen, ","))
+			}
+		},
+	}
+}
+
+// startDaemon starts docker-tunnel again as a background process, with
+// args starting with "up", and waits for its control socket to reply
+func startDaemon(name string, args []string) (*tunnelStatus, error) {
+	if _, err := callControl(name, controlStatus); err == nil {
+		return nil, fmt.Errorf("tunnel %s is already up", name)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	logPath, err := tunnelFile(name, ".log")
+	if err != nil {
+		return nil, err
+	}
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("can't open log file: %s", err)
+	}
+	defer logFile.Close()
+	logOffset, _ := logFile.Seek(0, os.SEEK_END)
+
+	// stdin is /dev/null: nothing can be prompted in the background,
+	// unknown host keys and encrypted keys without agent fail
+	daemon := exec.Command(executable, args...)
+	daemon.Env = append(os.Environ(), daemonEnv+"=1")
+	daemon.Stdout = logFile
+	daemon.Stderr = logFile
+	daemon.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := daemon.Start(); err != nil {
+		return nil, fmt.Errorf("can't start background tunnel: %s", err)
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- daemon.Wait()
+	}()
+
+	deadline := time.After(daemonStartTimeout)
+	for {
+		select {
+		case <-exited:
+			return nil, fmt.Errorf("tunnel %s failed to start: %s", name, daemonOutput(logPath, logOffset))
+		case <-deadline:
+			daemon.Process.Kill()
+			<-exited
+			return nil, fmt.Errorf("tunnel %s didn't start within %s: %s", name, daemonStartTimeout, daemonOutput(logPath, logOffset))
+		case <-time.After(100 * time.Millisecond):
+			if response, err := callControl(name, controlStatus); err == nil {
+				return response.Status, nil
+			}
+		}
+	}
+}
+
+// daemonOutput returns the last lines a background tunnel
+// logged after offset, for error messages
+func daemonOutput(logPath string, offset int64) string {
+	output := ""
+	if content, err := ioutil.ReadFile(logPath); err == nil && int64(len(content)) >= offset {
+		output = strings.TrimSpace(string(content[offset:]))
+	}
+	if output == "" {
+		if logFilePath != "" {
+			return "see " + logFilePath
+		}
+		return "nothing logged"
+	}
+	lines := strings.Split(output, "\n")
+	if len(lines) > daemonLogTailLines {
+		lines = lines[len(lines)-daemonLogTailLines:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// stopDaemon asks a background tunnel to stop, and waits for it to exit.
+// Files left by a tunnel that didn't exit cleanly are removed.
+func stopDaemon(name string) error {
+	controlPath, err := tunnelFile(name, ".ctl")
+	if err != nil {
+		return err
+	}
+	pidPath, err := tunnelFile(name, ".pid")
+	if err != nil {
+		return err
+	}
+
+	response, err := callControl(name, controlStatus)
+	if err != nil {
+		_, pidErr := os.Stat(pidPath)
+		os.Remove(controlPath)
+		os.Remove(pidPath)
+		if pidErr == nil {
+			return errors.New("tunnel isn't running anymore (stale files removed)")
+		}
+		return errTunnelNotUp
+	}
+	if _, err := callControl(name, controlStop); err != nil {
+		return err
+	}
+
+	timeout := response.Status.ShutdownTimeout + daemonStopTimeout
+	deadline := time.Now().Add(timeout)
+	for syscall.Kill(response.Status.Pid, 0) == nil {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("tunnel still running after %s (pid %d)", timeout, response.Status.Pid)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
+
+// listDaemons returns the status of background tunnels, sorted by name.
+// Files left by tunnels that didn't exit cleanly are removed.
+func listDaemons() ([]*tunnelStatus, error) {
+	dir, err := runtimeDir()
+	if err != nil {
+		return nil, err
+	}
+	// sorted by filepath.Glob
+	controlPaths, err := filepath.Glob(filepath.Join(dir, "*.ctl"))
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]*tunnelStatus, 0, len(controlPaths))
+	for _, controlPath := range controlPaths {
+		name := strings.TrimSuffix(filepath.Base(controlPath), ".ctl")
+		response, err := callControl(name, controlStatus)
+		if err != nil {
+			printDebug("removing stale tunnel files:", name, err)
+			os.Remove(controlPath)
+			os.Remove(strings.TrimSuffix(controlPath, ".ctl") + ".pid")
+			continue
+		}
+		statuses = append(statuses, response.Status)
+	}
+	return statuses, nil
+}
+
+// callControl sends a command to the control socket of a background tunnel
+func callControl(name, command string) (*controlResponse, error) {
+	controlPath, err := tunnelFile(name, ".ctl")
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("unix", controlPath, controlTimeout)
+	if err != nil {
+		return nil, errTunnelNotUp
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	if err := json.NewEncoder(conn).Encode(&controlRequest{Command: command}); err != nil {
+		return nil, err
+	}
+	response := &controlResponse{}
+	if err := json.NewDecoder(conn).Decode(response); err != nil {
+		return nil, fmt.Errorf("can't read control socket reply: %s", err)
+	}
+	if response.Error != "" {
+		return nil, errors.New(response.Error)
+	}
+	return response, nil
+}
+
+// runDaemon runs a background tunnel, started by startDaemon.
+// Logs go to the file opened by startDaemon.
+func runDaemon(cmd *cobra.Command, userAtHost, name string) {
+	controlPath, err := tunnelFile(name, ".ctl")
+	if err != nil {
+		printFatal(err)
+	}
+	pidPath, err := tunnelFile(name, ".pid")
+	if err != nil {
+		printFatal(err)
+	}
+
+	pool, remoteAddr := connectTunnel(cmd, userAtHost)
+	defer pool.Close()
+
+	listeners, err := proxyListeners(cmd)
+	if err != nil {
+		printFatal(err)
+	}
+
+	// startDaemon checked no tunnel replies on it
+	os.Remove(controlPath)
+	control, err := net.Listen("unix", controlPath)
+	if err != nil {
+		printFatal(err)
+	}
+	defer control.Close()
+
+	if err := ioutil.WriteFile(pidPath, []byte(strconv.Itoa(os.Getpid())+"\n"), 0600); err != nil {
+		printFatal(err)
+	}
+	defer os.Remove(pidPath)
+
+	status := &tunnelStatus{
+		Name:       name,
+		Host:       userAtHost,
+		Pid:        os.Getpid(),
+		Started:    time.Now(),
+		RemoteAddr: remoteAddr,
+
+		ShutdownTimeout: shutdownTimeout,
+	}
+	for _, ln := range listeners {
+		status.Listen = append(status.Listen, listenerURL(ln))
+		print("listening on " + listenerURL(ln) + "...")
+		startServing(ln, pool, remoteAddr)
+	}
+
+	// stop requests are handled like SIGTERM: the first one drains
+	// streams, the second one forces the tunnel to stop
+	signals := shutdownSignals()
+	go serveControl(control, status, pool, signals)
+
+	sig := <-signals
+	print("stopping tunnel:", sig)
+	// the control socket keeps replying while draining
+	drain(listeners, shutdownTimeout, signals)
+}
+
+// serveControl replies to control requests, and sends SIGTERM
+// to stop when the tunnel is asked to stop
+func serveControl(ln net.Listener, status *tunnelStatus, pool *sshPool, stop chan<- os.Signal) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		conn.SetDeadline(time.Now().Add(controlTimeout))
+		request := &controlRequest{}
+		response := &controlResponse{}
+		if err := json.NewDecoder(conn).Decode(request); err != nil {
+			response.Error = fmt.Sprintf("invalid request: %s", err)
+		} else {
+			switch request.Command {
+			case controlStatus:
+				current := *status
+				current.SSHConnections = pool.States()
+				current.ActiveStreams = atomic.LoadInt64(&activeStreams)
+				current.TotalStreams = atomic.LoadUint64(&totalStreams)
+				current.StreamErrors = atomic.LoadUint64(&streamErrors)
+				current.BytesSent = atomic.LoadUint64(&bytesSent)
+				current.BytesReceived = atomic.LoadUint64(&bytesReceived)
+				response.Status = &current
+			case controlStop:
+				select {
+				case stop <- syscall.SIGTERM:
+				default:
+				}
+			default:
+				response.Error = "unknown command: " + request.Command
+			}
+		}
+		json.NewEncoder(conn).Encode(response)
+		conn.Close()
+	}
+}
+
+// printTunnelStatus prints the status of a background tunnel
+func printTunnelStatus(status *tunnelStatus) {
+	fmt.Printf("tunnel:           %s (pid %d, up %s)\n", status.Name, status.Pid, formatUptime(status.Started))
+	fmt.Printf("host:             %s\n", status.Host)
+	fmt.Printf("listening on:     %s\n", strings.Join(status.Listen, ", "))
+	fmt.Printf("Docker endpoint:  %s\n", status.RemoteAddr)
+	fmt.Printf("ssh connections:  %s\n", strings.Join(status.SSHConnections, ", "))
+	fmt.Printf("streams:          %d active, %d total, %d errors\n", status.ActiveStreams, status.TotalStreams, status.StreamErrors)
+	fmt.Printf("transferred:      %s sent, %s received\n", formatBytes(status.BytesSent), formatBytes(status.BytesReceived))
+}
+
+func formatUptime(started time.Time) string {
+	return (time.Since(started) / time.Second * time.Second).String()
+}
+
+// formatBytes formats a byte count with a binary unit
+func formatBytes(n uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(n)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"unsafe"
+)
+
+// signals forwarded to the command run by exec
+var forwardedSignals = []os.Signal{
+	syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT,
+	syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGWINCH,
+}
+
+// signals the terminal sends to its whole foreground process group
+// (Ctrl-C, Ctrl-\, resize). The command is in docker-tunnel's group:
+// when it's in the foreground, the command got them already, and
+// forwarding them would deliver them twice (a second SIGINT forces
+// docker compose to kill containers).
+var terminalSignals = []os.Signal{
+	syscall.SIGINT, syscall.SIGQUIT, syscall.SIGWINCH,
+}
+
+// runExec runs a command with DOCKER_HOST pointing to the remote
+// Docker host, forwarding signals to it until it exits. It returns
+// the command's exit status, 128+n if it was killed by signal n (like
+// shells do) and 127 if it couldn't be started. The socket is removed
+// before returning, or exiting.
+func runExec(name string, pool *sshPool, remoteAddr string, command []string) int {
+	printDebug("exec mode")
+
+	socketPath, ln := listenSessionSocket(name)
+	defer os.Remove(socketPath)
+	addExitHook(func() {
+		os.Remove(socketPath)
+	})
+
+	startServing(ln, pool, remoteAddr)
+
+	c := exec.Command(command[0], command[1:]...)
+	c.Env = append(os.Environ(), "DOCKER_HOST=unix://"+socketPath)
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	c.Stdin = os.Stdin
+
+	// signals are caught before starting the command,
+	// so that none of them can kill docker-tunnel
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardedSignals...)
+	defer signal.Stop(signals)
+
+	if err := c.Start(); err != nil {
+		printError(err)
+		return 127
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				if isTerminalSignal(sig) && inForeground() {
+					printDebug("not forwarding signal from the terminal:", sig)
+					continue
+				}
+				printDebug("forwarding signal:", sig)
+				c.Process.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err := c.Wait()
+	close(done)
+
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			if status.Signaled() {
+				return 128 + int(status.Signal())
+			}
+			return status.ExitStatus()
+		}
+	}
+	printError(err)
+	return 1
+}
+
+func isTerminalSignal(sig os.Signal) bool {
+	for _, s := range terminalSignals {
+		if s == sig {
+			return true
+		}
+	}
+	return false
+}
+
+// inForeground returns true if docker-tunnel's process group is the
+// foreground process group of its controlling terminal
+func inForeground() bool {
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		// no controlling terminal
+		return false
+	}
+	defer tty.Close()
+
+	var pgrp int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, tty.Fd(), uintptr(syscall.TIOCGPGRP), uintptr(unsafe.Pointer(&pgrp)))
+	if errno != 0 {
+		return false
+	}
+	return int(pgrp) == syscall.Getpgrp()
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/aduermael/crypto/ssh"
+)
+
+const (
+	// strict host key checking modes, same semantics as OpenSSH's
+	// StrictHostKeyChecking option
+	hostKeyCheckingYes       = "yes"
+	hostKeyCheckingAsk       = "ask"
+	hostKeyCheckingAcceptNew = "accept-new"
+
+	knownHostsMarkerCertAuthority = "cert-authority"
+	knownHostsMarkerRevoked       = "revoked"
+
+	knownHostsHashMagic = "|1|"
+)
+
+// knownHostsEntry is one parsed line of a known_hosts file
+type knownHostsEntry struct {
+	marker   string
+	patterns []string
+	key      ssh.PublicKey
+}
+
+// knownHosts verifies server host keys against a known_hosts file
+type knownHosts struct {
+	path    string
+	mode    string
+	entries []knownHostsEntry
+}
+
+// defaultKnownHostsPath returns ~/.ssh/known_hosts
+func defaultKnownHostsPath() (string, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(usr.HomeDir, ".ssh", "known_hosts"), nil
+}
+
+// newKnownHosts loads known_hosts entries from path.
+// A missing file is not an error, it is created when the first
+// host key gets accepted.
+func newKnownHosts(path, mode string) (*knownHosts, error) {
+	switch mode {
+	case hostKeyCheckingYes, hostKeyCheckingAsk, hostKeyCheckingAcceptNew:
+	default:
+		return nil, fmt.Errorf("invalid strict host key checking mode: %s (yes, ask or accept-new expected)", mode)
+	}
+
+	kh := &knownHosts{path: path, mode: mode}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return kh, nil
+		}
+		return nil, err
+	}
+
+	// lines that can't be parsed (key types that aren't supported,
+	// truncated lines...) are ignored, like OpenSSH does
+	for i, line := range bytes.Split(content, []byte("\n")) {
+		marker, hosts, key, _, _, err := ssh.ParseKnownHosts(line)
+		if err == io.EOF {
+			// empty line or comment
+			continue
+		}
+		if err != nil {
+			printDebug(fmt.Sprintf("ignoring line %d of %s: %s", i+1, path, err))
+			continue
+		}
+		kh.entries = append(kh.entries, knownHostsEntry{
+			marker:   marker,
+			patterns: hosts,
+			key:      key,
+		})
+	}
+
+	return kh, nil
+}
+
+// HostKeyCallback can be used as ssh.ClientConfig.HostKeyCallback
+func (kh *knownHosts) HostKeyCallback(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	host := knownHostsAddr(hostname)
+
+	// revoked keys are rejected, whatever the mode, including
+	// when wrapped in a certificate or used to sign it
+	revoked := kh.isRevoked(key)
+	if cert, ok := key.(*ssh.Certificate); ok {
+		revoked = revoked || kh.isRevoked(cert.Key) || kh.isRevoked(cert.SignatureKey)
+	}
+	if revoked {
+		return fmt.Errorf("host key for %s is marked as revoked in %s", host, kh.path)
+	}
+
+	if cert, ok := key.(*ssh.Certificate); ok {
+		if kh.hasAuthority(host) {
+			return kh.checkCert(host, hostname, cert)
+		}
+		// no authority known for this host,
+		// fall back to checking the certified key itself
+		printDebug("no certificate authority known for", host)
+		key = cert.Key
+	}
+
+	sameType := false
+	for _, e := range kh.entries {
+		if e.marker != "" || !e.matches(host) {
+			continue
+		}
+		if keysEqual(e.key, key) {
+			printDebug("host key found in", kh.path)
+			return nil
+		}
+		if e.key.Type() == key.Type() {
+			sameType = true
+		}
+	}
+
+	if sameType {
+		return fmt.Errorf("host key for %s has changed (%s %s), it may be a man-in-the-middle attack. "+
+			"Remove the old key from %s if the change is expected",
+			host, key.Type(), ssh.FingerprintSHA256(key), kh.path)
+	}
+
+	return kh.unknownHost(host, key)
+}
+
+// isRevoked returns true if key is marked as @revoked
+func (kh *knownHosts) isRevoked(key ssh.PublicKey) bool {
+	for _, e := range kh.entries {
+		if e.marker == knownHostsMarkerRevoked && keysEqual(e.key, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAuthority returns true if a @cert-authority entry matches host
+func (kh *knownHosts) hasAuthority(host string) bool {
+	for _, e := range kh.entries {
+		if e.marker == knownHostsMarkerCertAuthority && e.matches(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCert validates a host certificate against @cert-authority entries
+func (kh *knownHosts) checkCert(host, hostname string, cert *ssh.Certificate) error {
+	principal, _, err := net.SplitHostPort(hostname)
+	if err != nil {
+		principal = hostname
+	}
+
+	checker := &ssh.CertChecker{
+		IsAuthority: func(auth ssh.PublicKey) bool {
+			for _, e := range kh.entries {
+				if e.marker == knownHostsMarkerCertAuthority && e.matches(host) && keysEqual(e.key, auth) {
+					return true
+				}
+			}
+			return false
+		},
+		IsRevoked: func(cert *ssh.Certificate) bool {
+			return kh.isRevoked(cert.Key) || kh.isRevoked(cert.SignatureKey)
+		},
+	}
+
+	if cert.CertType != ssh.HostCert {
+		return fmt.Errorf("certificate presented by %s is not a host certificate", host)
+	}
+	if err := checker.CheckCert(principal, cert); err != nil {
+		return fmt.Errorf("can't verify host certificate for %s: %s", host, err)
+	}
+
+	printDebug("host certificate signed by known authority")
+	return nil
+}
+
+// unknownHost applies strict host key checking mode to a host
+// that can't be found in known_hosts
+func (kh *knownHosts) unknownHost(host string, key ssh.PublicKey) error {
+	fingerprint := ssh.FingerprintSHA256(key)
+
+	switch kh.mode {
+	case hostKeyCheckingYes:
+		return fmt.Errorf("no %s host key is known for %s (%s) and strict host key checking is enabled",
+			key.Type(), host, fingerprint)
+	case hostKeyCheckingAsk:
+		fmt.Fprintf(os.Stderr, "The authenticity of host '%s' can't be established.\n", host)
+		fmt.Fprintf(os.Stderr, "%s key fingerprint is %s.\n", key.Type(), fingerprint)
+		fmt.Fprint(os.Stderr, "Are you sure you want to continue connecting (yes/no)? ")
+		answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if strings.TrimSpace(strings.ToLower(answer)) != "yes" {
+			return errors.New("host key verification failed")
+		}
+	case hostKeyCheckingAcceptNew:
+		printDebug("accepting new host key for", host)
+	}
+
+	if err := kh.add(host, key); err != nil {
+		return fmt.Errorf("can't add host key to %s: %s", kh.path, err)
+	}
+	printWarn("Permanently added '" + host + "' (" + key.Type() + ") to the list of known hosts.")
+	return nil
+}
+
+// add appends a host key to the known_hosts file
+func (kh *knownHosts) add(host string, key ssh.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(kh.path), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(kh.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// make sure we start on a new line
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			if _, err := f.Write([]byte("\n")); err != nil {
+				return err
+			}
+		}
+	}
+
+	line := host + " " + string(ssh.MarshalAuthorizedKey(key))
+	if _, err := f.Write([]byte(line)); err != nil {
+		return err
+	}
+
+	kh.entries = append(kh.entries, knownHostsEntry{patterns: []string{host}, key: key})
+	return nil
+}
+
+// matches returns true if host matches entry's host patterns.
+// Negated patterns (!pattern) exclude the host even if
+// another pattern matches.
+func (e knownHostsEntry) matches(host string) bool {
+	matched := false
+	for _, pattern := range e.patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		if negated {
+			pattern = pattern[1:]
+		}
+		if !matchKnownHostsPattern(pattern, host) {
+			continue
+		}
+		if negated {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// matchKnownHostsPattern matches host against a single known_hosts
+// pattern, that can be hashed (|1|salt|hash) or contain wildcards
+func matchKnownHostsPattern(pattern, host string) bool {
+	if strings.HasPrefix(pattern, knownHostsHashMagic) {
+		parts := strings.Split(pattern[len(knownHostsHashMagic):], "|")
+		if len(parts) != 2 {
+			return false
+		}
+		salt, err := base64.StdEncoding.DecodeString(parts[0])
+		if err != nil {
+			return false
+		}
+		hash, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return false
+		}
+		mac := hmac.New(sha1.New, salt)
+		mac.Write([]byte(host))
+		return hmac.Equal(mac.Sum(nil), hash)
+	}
+	return matchWildcard(strings.ToLower(pattern), strings.ToLower(host))
+}
+
+// matchWildcard matches s against a pattern where '*' matches
+// any sequence of characters and '?' matches exactly one.
+// Unlike path.Match, '[' has no special meaning.
+func matchWildcard(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if matchWildcard(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+	return len(s) == 0
+}
+
+// knownHostsAddr returns the known_hosts representation of a
+// host:port address: "host" for port 22, "[host]:port" otherwise
+func knownHostsAddr(hostport string) string {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	if port == "22" {
+		return host
+	}
+	return "[" + host + "]:" + port
+}
+
+func keysEqual(a, b ssh.PublicKey) bool {
+	return bytes.Equal(a.Marshal(), b.Marshal())
+}
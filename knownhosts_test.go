@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aduermael/crypto/ssh"
+)
+
+func newTestSigner(t testing.TB) ssh.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func newTestHostCert(t *testing.T, key ssh.PublicKey, ca ssh.Signer) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{"host.corp"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestKnownHostsRevokedCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "known_hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestSigner(t)
+	revokedCA := newTestSigner(t)
+	revoked := newTestSigner(t).PublicKey()
+
+	tests := []struct {
+		name  string
+		lines string
+		cert  *ssh.Certificate
+	}{
+		{
+			name: "revoked key signed by known authority",
+			lines: "@cert-authority *.corp " + string(ssh.MarshalAuthorizedKey(ca.PublicKey())) +
+				"@revoked * " + string(ssh.MarshalAuthorizedKey(revoked)),
+			cert: newTestHostCert(t, revoked, ca),
+		},
+		{
+			name:  "revoked key without known authority",
+			lines: "@revoked * " + string(ssh.MarshalAuthorizedKey(revoked)),
+			cert:  newTestHostCert(t, revoked, ca),
+		},
+		{
+			name:  "revoked authority",
+			lines: "@revoked * " + string(ssh.MarshalAuthorizedKey(revokedCA.PublicKey())),
+			cert:  newTestHostCert(t, newTestSigner(t).PublicKey(), revokedCA),
+		},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name)
+		if err := ioutil.WriteFile(path, []byte(test.lines), 0600); err != nil {
+			t.Fatal(err)
+		}
+		kh, err := newKnownHosts(path, hostKeyCheckingAcceptNew)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := kh.HostKeyCallback("host.corp:22", nil, test.cert); err == nil {
+			t.Errorf("%s: certificate accepted", test.name)
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != test.lines {
+			t.Errorf("%s: known_hosts changed:\n%s", test.name, content)
+		}
+	}
+}
+
+func TestKnownHostsCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "known_hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestSigner(t)
+	path := filepath.Join(dir, "known_hosts")
+	line := "@cert-authority *.corp " + string(ssh.MarshalAuthorizedKey(ca.PublicKey()))
+	if err := ioutil.WriteFile(path, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+	kh, err := newKnownHosts(path, hostKeyCheckingYes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := newTestHostCert(t, newTestSigner(t).PublicKey(), ca)
+	if err := kh.HostKeyCallback("host.corp:22", nil, cert); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKnownHostsInvalidLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "known_hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	known := newTestSigner(t).PublicKey()
+	revoked := newTestSigner(t).PublicKey()
+
+	// security key, not supported by the vendored ssh package
+	skKey := ssh.Marshal(struct {
+		Type        string
+		Key         []byte
+		Application string
+	}{"sk-ssh-ed25519@openssh.com", make([]byte, 32), "ssh:"})
+	truncated := string(ssh.MarshalAuthorizedKey(newTestSigner(t).PublicKey()))
+	truncated = truncated[:len(truncated)/2]
+
+	lines := "# comment\n" +
+		"sk.example.com sk-ssh-ed25519@openssh.com " + base64.StdEncoding.EncodeToString(skKey) + "\n" +
+		"truncated.example.com " + truncated + "\n" +
+		"known.example.com " + string(ssh.MarshalAuthorizedKey(known)) +
+		"\n" +
+		"invalid entry with too many fields\n" +
+		"@revoked * " + string(ssh.MarshalAuthorizedKey(revoked))
+
+	path := filepath.Join(dir, "known_hosts")
+	if err := ioutil.WriteFile(path, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+	kh, err := newKnownHosts(path, hostKeyCheckingYes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kh.entries) != 2 {
+		t.Errorf("%d entries, 2 expected", len(kh.entries))
+	}
+
+	// entries before and after invalid lines are used
+	if err := kh.HostKeyCallback("known.example.com:22", nil, known); err != nil {
+		t.Error(err)
+	}
+	if err := kh.HostKeyCallback("revoked.example.com:22", nil, revoked); err == nil {
+		t.Error("revoked key accepted")
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// proxy mode default listen address, only reachable locally
+	defaultListenAddr = "tcp://127.0.0.1:2375"
+	// host used when a tcp listen address has none
+	defaultListenHost = "127.0.0.1"
+	// delays between Accept retries after temporary errors
+	acceptMinDelay = 5 * time.Millisecond
+	acceptMaxDelay = time.Second
+)
+
+// parseListenAddr parses a listen address, tcp://[host]:port or
+// unix:///path, and returns network and address to be used with
+// net.Listen. Host defaults to 127.0.0.1 and port can be 0 to use
+// any available port. The tcp:// prefix can be omitted.
+func parseListenAddr(listenAddr string) (string, string, error) {
+	if !strings.Contains(listenAddr, "://") {
+		listenAddr = "tcp://" + listenAddr
+	}
+
+	u, err := url.Parse(listenAddr)
+	if err != nil {
+		return "", "", fmt.Errorf("can't parse listen address: %s", listenAddr)
+	}
+
+	switch u.Scheme {
+	case "unix":
+		if u.Path == "" {
+			return "", "", fmt.Errorf("missing socket path in listen address: %s", listenAddr)
+		}
+		return "unix", u.Path, nil
+	case "tcp":
+		host, port, err := net.SplitHostPort(u.Host)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid listen address: %s (%s)", listenAddr, err)
+		}
+		if host == "" {
+			host = defaultListenHost
+		}
+		return "tcp", net.JoinHostPort(host, port), nil
+	default:
+		return "", "", fmt.Errorf("unsupported listen address: %s (tcp:// or unix:// expected)", listenAddr)
+	}
+}
+
+// listen opens a listener for listenAddr (see parseListenAddr)
+func listen(listenAddr string) (net.Listener, error) {
+	network, addr, err := parseListenAddr(listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		removeStaleSocket(addr)
+	}
+	return net.Listen(network, addr)
+}
+
+// removeStaleSocket removes the unix socket at path if nothing accepts
+// connections on it anymore, left by a process that got killed
+func removeStaleSocket(path string) {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return
+	}
+	if ne, ok := err.(*net.OpError); ok {
+		if se, ok := ne.Err.(*os.SyscallError); ok && se.Err == syscall.ECONNREFUSED {
+			printDebug("removing stale socket:", path)
+			os.Remove(path)
+		}
+	}
+}
+
+// listenerURL returns the address a listener is bound to, in the
+// format expected by DOCKER_HOST (chosen port included)
+func listenerURL(ln net.Listener) string {
+	addr := ln.Addr()
+	if addr.Network() == "unix" {
+		return "unix://" + addr.String()
+	}
+	return "tcp://" + addr.String()
+}
+
+// startServing runs serve in the background. The serve loop is
+// counted before returning, so that drain always waits for it.
+func startServing(ln net.Listener, pool *sshPool, remoteAddr string) {
+	serving.Add(1)
+	go func() {
+		defer serving.Done()
+		serve(ln, pool, remoteAddr)
+	}()
+}
+
+// serve accepts connections on ln and forwards them to the remote
+// Docker endpoint, until ln returns a non temporary error or gets
+// closed by drain
+func serve(ln net.Listener, pool *sshPool, remoteAddr string) {
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if atomic.LoadInt32(&shuttingDown) == 1 {
+				printDebug("stopped listening on", listenerURL(ln))
+				return
+			}
+			// running out of file descriptors for example,
+			// wait a bit like net/http does
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = acceptMinDelay
+				} else if delay *= 2; delay > acceptMaxDelay {
+					delay = acceptMaxDelay
+				}
+				printWarn("can't accept connection:", err.Error(), "(retrying in "+delay.String()+")")
+				time.Sleep(delay)
+				continue
+			}
+			printError("stopped listening on "+listenerURL(ln)+":", err.Error())
+			return
+		}
+		delay = 0
+		streams.Add(1)
+		go func() {
+			defer streams.Done()
+			handleProxyConnection(conn, pool, remoteAddr)
+		}()
+	}
+}
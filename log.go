@@ -1,39 +1,169 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
 	logLevelDebug int = iota
-	logLevelError
 	logLevelInfo
+	logLevelWarn
+	logLevelError
+)
+
+// log formats (--log-format)
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
 )
 
 var (
-	logLevel = logLevelInfo
+	logLevel  = logLevelInfo
+	logFormat = logFormatText
+	// logs never go to stdout, that's where
+	// commands started by docker-tunnel write
+	logOutput io.Writer = os.Stderr
+	logMu     sync.Mutex
+
+	logLevelNames = []string{"debug", "info", "warn", "error"}
+
+	// logger without fields, used by print functions
+	rootLogger = &logger{}
 )
 
-func print(args ...interface{}) {
-	if logLevel <= logLevelInfo {
-		fmt.Println(args...)
+// logger attaches fields (connection ID...) to messages
+type logger struct {
+	fields []logField
+}
+
+type logField struct {
+	key   string
+	value interface{}
+}
+
+// with returns a logger adding key=value to messages
+func (l *logger) with(key string, value interface{}) *logger {
+	fields := make([]logField, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+	return &logger{fields: append(fields, logField{key: key, value: value})}
+}
+
+func (l *logger) debug(args ...interface{}) {
+	l.log(logLevelDebug, args...)
+}
+
+func (l *logger) info(args ...interface{}) {
+	l.log(logLevelInfo, args...)
+}
+
+func (l *logger) warn(args ...interface{}) {
+	l.log(logLevelWarn, args...)
+}
+
+func (l *logger) error(args ...interface{}) {
+	l.log(logLevelError, args...)
+}
+
+func (l *logger) log(level int, args ...interface{}) {
+	if level < logLevel {
+		return
+	}
+	now := time.Now()
+	msg := strings.TrimSuffix(fmt.Sprintln(args...), "\n")
+
+	var line []byte
+	if logFormat == logFormatJSON {
+		entry := map[string]interface{}{
+			"time":  now.Format(time.RFC3339Nano),
+			"level": logLevelNames[level],
+			"msg":   msg,
+		}
+		for _, field := range l.fields {
+			entry[field.key] = field.value
+		}
+		line, _ = json.Marshal(entry)
+		line = append(line, '\n')
+	} else {
+		var buf bytes.Buffer
+		buf.WriteString(now.Format("2006-01-02T15:04:05.000Z07:00"))
+		buf.WriteString(" " + fmt.Sprintf("%-5s", strings.ToUpper(logLevelNames[level])))
+		buf.WriteString(" " + msg)
+		for _, field := range l.fields {
+			value := fmt.Sprint(field.value)
+			if strings.ContainsAny(value, " \"=") {
+				value = strconv.Quote(value)
+			}
+			buf.WriteString(" " + field.key + "=" + value)
+		}
+		buf.WriteByte('\n')
+		line = buf.Bytes()
 	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	logOutput.Write(line)
 }
 
-func printError(args ...interface{}) {
-	if logLevel <= logLevelError {
-		fmt.Fprintln(os.Stderr, args...)
+// configureLogging applies logging flags
+func configureLogging() error {
+	level := -1
+	for i, name := range logLevelNames {
+		if name == logLevelName {
+			level = i
+		}
+	}
+	if level < 0 {
+		return fmt.Errorf("invalid log level: %s (debug, info, warn or error expected)", logLevelName)
+	}
+	if verbose {
+		level = logLevelDebug
+	}
+
+	switch logFormatName {
+	case logFormatText, logFormatJSON:
+	default:
+		return fmt.Errorf("invalid log format: %s (text or json expected)", logFormatName)
+	}
+
+	if logFilePath != "" {
+		file, err := os.OpenFile(logFilePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return fmt.Errorf("can't open log file: %s", err)
+		}
+		logOutput = file
 	}
+
+	logLevel = level
+	logFormat = logFormatName
+	return nil
+}
+
+func print(args ...interface{}) {
+	rootLogger.info(args...)
+}
+
+func printWarn(args ...interface{}) {
+	rootLogger.warn(args...)
+}
+
+func printError(args ...interface{}) {
+	rootLogger.error(args...)
 }
 
 func printFatal(args ...interface{}) {
 	printError(args...)
+	runExitHooks()
 	os.Exit(1)
 }
 
 func printDebug(args ...interface{}) {
-	if logLevel <= logLevelDebug {
-		fmt.Println(args...)
-	}
+	rootLogger.debug(args...)
 }
@@ -1,20 +1,14 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/hex"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"io"
 	"net"
 	"net/url"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"regexp"
-	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aduermael/crypto/ssh"
@@ -22,266 +16,413 @@ import (
 )
 
 var (
-	// path to private key or empty to use default
-	sshIdentityFile = ""
+	// paths to private keys or empty to use defaults
+	sshIdentityFiles = []string{}
 	// open a bash session by default, but different option can be used
 	shell = "bash"
 	// proxy mode (don't start shell session)
 	proxyMode = false
 	// verbose mode (debug logs)
 	verbose = false
+	// comma separated list of jump hosts
+	proxyJump = ""
+	// path to ssh config file, ~/.ssh/config if empty
+	sshConfigFile = ""
+	// don't use keys from ssh-agent
+	noAgent = false
+	// seconds between keepalive requests, 0 to disable
+	serverAliveInterval = int(defaultServerAliveInterval / time.Second)
+	// missed keepalive replies before connection is considered dead
+	serverAliveCountMax = defaultServerAliveCountMax
+	// proxy mode listen addresses
+	listenAddrs = []string{defaultListenAddr}
+	// remote Docker endpoint (unix:// or tcp://), detected if empty
+	remoteDockerAddr = ""
+	// what to do with unknown host keys: yes, ask or accept-new
+	strictHostKeyChecking = hostKeyCheckingAsk
+	// serve TLS in proxy mode
+	tlsEnabled = false
+	// serve TLS and require client certificates in proxy mode
+	tlsVerify = false
+	// TLS files, from ~/.docker-tunnel/certs if empty
+	tlsCACert = ""
+	tlsCert   = ""
+	tlsKey    = ""
+	// how the remote Docker endpoint is reached: auto, direct, dial-stdio or socat
+	transportMode = transportAuto
+	// number of ssh connections proxied connections are spread over
+	poolSize = 1
+	// algorithm lists (OpenSSH syntax), override ssh config
+	sshCiphers       = ""
+	sshKexAlgorithms = ""
+	sshMACs          = ""
+	// proxied streams without traffic for that long are closed, 0 disables
+	idleTimeout time.Duration
+	// how long proxied streams are waited for when shutting down
+	shutdownTimeout = defaultShutdownTimeout
+	// minimum level of logged messages: debug, info, warn or error
+	logLevelName = "info"
+	// log format: text or json
+	logFormatName = logFormatText
+	// Docker API requests are logged to that file if set
+	auditLogPath = ""
+	// logs are written to that file if set, stderr otherwise
+	logFilePath = ""
 )
 
 func main() {
 
-	rootCmd := &cobra.Command{
-		Use:   "docker-tunnel [user@]host",
-		Short: "Docker-tunnel connects you to a remote Docker host through an SSH tunnel",
-		Run: func(cmd *cobra.Command, args []string) {
-			if verbose {
-				logLevel = logLevelDebug
-			}
-
-			if len(args) != 1 {
-				cmd.Usage()
-				return
-			}
-
-			sshClient, err := sshConnect(args[0], sshIdentityFile)
-			if err != nil {
-				printFatal(err)
-			}
-			defer sshClient.Close()
-
-			if proxyMode {
-				printDebug("proxy mode")
-
-				ln, err := net.Listen("tcp", ":2375")
-				if err != nil {
-					printFatal(err)
-				}
-				print("listening on port 2375...")
-				for {
-					conn, err := ln.Accept()
-					if err != nil {
-						printFatal(err)
-					}
-					go handleProxyConnection(conn, sshClient)
-				}
-			}
-
-			// proxyMode == false
-			// open shell session, connected to remote Docker host
-			printDebug("shell mode")
+	rootCmd := newConnectCommand("docker-tunnel [user@]host")
+	rootCmd.Short = "Docker-tunnel connects you to a remote Docker host through an SSH tunnel"
+	rootCmd.Long = `Docker-tunnel connects you to a remote Docker host through an SSH tunnel
+
+"docker-tunnel [user@]host" is short for "docker-tunnel connect [user@]host".
+
+Commands:
+  docker-tunnel connect [user@]host               Open a shell session (default command)
+  docker-tunnel shell [user@]host                 Open a shell session
+  docker-tunnel proxy [user@]host                 Expose the remote Docker API locally
+  docker-tunnel exec [user@]host -- command...    Run a command with DOCKER_HOST set
+  docker-tunnel up [user@]host                    Start a tunnel in the background
+  docker-tunnel down name|[user@]host             Stop a background tunnel
+  docker-tunnel ls                                List background tunnels
+  docker-tunnel status name|[user@]host           Show background tunnel status, or check the remote Docker daemon can be reached
+  docker-tunnel context install [user@]host       Start a background tunnel and create a Docker CLI context
+  docker-tunnel context remove name|[user@]host   Remove a Docker CLI context and stop its tunnel
+  docker-tunnel certs generate                    Generate TLS certificates for proxy mode
+
+Run "docker-tunnel <command> --help" for command flags.`
+
+	setupLogging := func(cmd *cobra.Command, args []string) {
+		if err := configureLogging(); err != nil {
+			printFatal(err)
+		}
+	}
+	rootCmd.PersistentPreRun = setupLogging
+
+	// cobra doesn't let a root command with subcommands take arguments,
+	// so other commands are defined separately and looked up first
+	otherCmds := &cobra.Command{Use: "docker-tunnel", PersistentPreRun: setupLogging}
+	otherCmds.AddCommand(
+		newConnectCommand("connect [user@]host"),
+		newShellCommand(),
+		newProxyCommand(),
+		newExecCommand(),
+		newUpCommand(),
+		newDownCommand(),
+		newLsCommand(),
+		newStatusCommand(),
+		newContextCommand(),
+		newCertsCommand(),
+	)
+	if cmd, _, err := otherCmds.Find(os.Args[1:]); err == nil && cmd != otherCmds {
+		if err := otherCmds.Execute(); err != nil {
+			printFatal(err.Error())
+		}
+		return
+	}
 
-			socketPath := tmpSocketPath()
-			printDebug("socket path:", socketPath)
+	if err := rootCmd.Execute(); err != nil {
+		printFatal(err.Error())
+	}
+}
 
-			ln, err := net.Listen("unix", socketPath)
-			if err != nil {
-				printFatal(err)
-			}
-			defer os.RemoveAll(socketPath)
+// sshTarget is an SSH server address, completed
+// with options from ssh config
+type sshTarget struct {
+	network       string
+	addr          string
+	user          string
+	identityFiles []string
+	proxyJump     string
+	// serverAliveInterval is nil when not set in ssh config
+	serverAliveInterval *time.Duration
+	serverAliveCountMax int
+	// algorithm lists from ssh config
+	ciphers       string
+	kexAlgorithms string
+	macs          string
+}
 
-			// listen in background
-			go func() {
-				for {
-					conn, err := ln.Accept()
-					if err != nil {
-						printFatal(err)
-					}
-					printDebug("handle socket connection")
-					go handleProxyConnection(conn, sshClient)
-				}
-			}()
+// resolveSSHTarget parses [user@]host[:port] (tcp:// prefix is accepted)
+// and completes it with options from ssh config. Host can be
+// an alias defined in ssh config.
+func resolveSSHTarget(userAtHost string, config *sshConfig) (*sshTarget, error) {
+	user := ""
+	host := userAtHost
+	if i := strings.LastIndex(userAtHost, "@"); i != -1 {
+		user = userAtHost[:i]
+		host = userAtHost[i+1:]
+	}
 
-			os.Setenv("PS1", "🐳  $ ")
-			os.Setenv("DOCKER_HOST", "unix://"+socketPath)
+	network := "tcp"
+	if strings.Contains(host, "://") {
+		u, err := url.Parse(host)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse host: %s", err)
+		}
+		network = u.Scheme
+		host = u.Host + u.Path
+	}
 
-			sh := exec.Command(shell)
-			sh.Stdout = os.Stdout
-			sh.Stderr = os.Stderr
-			sh.Stdin = os.Stdin
+	port := ""
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host = h
+		port = p
+	}
 
-			_ = sh.Run()
-		},
+	hostConfig, err := config.resolve(host, user)
+	if err != nil {
+		return nil, err
 	}
 
-	rootCmd.Flags().StringVarP(&sshIdentityFile, "sshid", "i", "", "path to private key")
-	rootCmd.Flags().StringVarP(&shell, "shell", "s", "bash", "shell to open session")
-	rootCmd.Flags().BoolVarP(&proxyMode, "proxy", "p", false, "proxy mode (don't start shell session)")
-	rootCmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "verbose mode (debug logs)")
+	if user == "" {
+		user = hostConfig.User
+	}
+	// root user by default
+	if user == "" {
+		user = "root"
+	}
+	if port == "" {
+		port = hostConfig.Port
+	}
+	// port is required, used 22 by default
+	if port == "" {
+		port = "22"
+	}
 
-	if err := rootCmd.Execute(); err != nil {
-		printFatal(err.Error())
+	var serverAliveInterval *time.Duration
+	if hostConfig.ServerAliveIntervalSet {
+		serverAliveInterval = &hostConfig.ServerAliveInterval
 	}
-}
 
-func tmpSocketPath() string {
-	randBytes := make([]byte, 16)
-	rand.Read(randBytes)
-	return filepath.Join(os.TempDir(), "docker-"+hex.EncodeToString(randBytes)+".sock")
+	return &sshTarget{
+		network:             network,
+		addr:                net.JoinHostPort(hostConfig.HostName, port),
+		user:                user,
+		identityFiles:       hostConfig.IdentityFiles,
+		proxyJump:           hostConfig.ProxyJump,
+		serverAliveInterval: serverAliveInterval,
+		serverAliveCountMax: hostConfig.ServerAliveCountMax,
+		ciphers:             hostConfig.Ciphers,
+		kexAlgorithms:       hostConfig.KexAlgorithms,
+		macs:                hostConfig.MACs,
+	}, nil
 }
 
-func sshConnect(userAtHost, privateKeyPath string) (*ssh.Client, error) {
-	// root user by default
-	user := "root"
-	host := ""
-	userAndHost := strings.SplitN(userAtHost, "@", 2)
-	if len(userAndHost) == 1 {
-		host = userAndHost[0]
-	} else {
-		user = userAndHost[0]
-		host = userAndHost[1]
+// keepAliveSettings returns keepalive interval and maximum number of
+// missed replies for userAtHost. Flags have precedence over ssh config.
+func keepAliveSettings(cmd *cobra.Command, userAtHost string) (time.Duration, int, error) {
+	if serverAliveInterval < 0 {
+		return 0, 0, errors.New("server alive interval can't be negative")
+	}
+	if serverAliveCountMax < 1 {
+		return 0, 0, errors.New("server alive count max must be at least 1")
 	}
 
-	printDebug("user:", user)
+	interval := time.Duration(serverAliveInterval) * time.Second
+	countMax := serverAliveCountMax
 
-	u, err := url.Parse(host)
+	sshConfig, err := loadSSHConfig(sshConfigFile)
 	if err != nil {
-		return nil, fmt.Errorf("ssh connection can't be established: %s", err)
+		return 0, 0, fmt.Errorf("can't read ssh config: %s", err)
 	}
-	if u.Scheme == "" {
-		u.Scheme = "tcp"
+	target, err := resolveSSHTarget(userAtHost, sshConfig)
+	if err != nil {
+		return 0, 0, err
 	}
 
-	authMethod, err := authMethodPublicKeys(privateKeyPath)
-	if err != nil {
-		printFatal(err)
+	if !cmd.Flags().Changed("server-alive-interval") && target.serverAliveInterval != nil {
+		interval = *target.serverAliveInterval
 	}
-	config := &ssh.ClientConfig{
-		User: user,
-		Auth: []ssh.AuthMethod{authMethod},
+	if !cmd.Flags().Changed("server-alive-count-max") && target.serverAliveCountMax > 0 {
+		countMax = target.serverAliveCountMax
 	}
 
-	addr := u.Host + u.Path
-	parts := strings.Split(addr, ":")
-	lastPart := parts[len(parts)-1]
-	_, err = strconv.Atoi(lastPart)
-	// port is required, used 22 by default
+	printDebug("keepalive interval:", interval, "count max:", countMax)
+
+	return interval, countMax, nil
+}
+
+// sshConnect connects to userAtHost, through jump hosts
+// if defined with -J flag or ProxyJump in ssh config
+func sshConnect(userAtHost string, privateKeyPaths []string) (*sshHost, error) {
+	sshConfig, err := loadSSHConfig(sshConfigFile)
 	if err != nil {
-		addr += ":22"
+		return nil, fmt.Errorf("can't read ssh config: %s", err)
 	}
 
-	printDebug("address:", u.Scheme+"://"+addr)
-
-	sshClientConn, err := ssh.Dial(u.Scheme, addr, config)
+	target, err := resolveSSHTarget(userAtHost, sshConfig)
 	if err != nil {
 		return nil, fmt.Errorf("ssh connection can't be established: %s", err)
 	}
 
-	printDebug("ssh connection established")
+	// -J flag has precedence over ssh config
+	jumps := proxyJump
+	if jumps == "" {
+		jumps = target.proxyJump
+	}
 
-	return sshClientConn, nil
-}
+	hops := make([]*sshTarget, 0)
+	if jumps != "" && jumps != sshConfigNone {
+		for _, jump := range strings.Split(jumps, ",") {
+			hop, err := resolveSSHTarget(strings.TrimSpace(jump), sshConfig)
+			if err != nil {
+				return nil, fmt.Errorf("can't parse jump host: %s", err)
+			}
+			hops = append(hops, hop)
+		}
+	}
+	hops = append(hops, target)
 
-func handleProxyConnection(conn net.Conn, sshClient *ssh.Client) {
-	err := forward(conn, sshClient, "unix:///var/run/docker.sock")
+	knownHostsPath, err := defaultKnownHostsPath()
 	if err != nil {
-		printError(os.Stderr, "can't forward connection:", err.Error())
+		return nil, err
 	}
-}
-
-func forward(conn net.Conn, sshClient *ssh.Client, remoteAddr string) error {
-
-	// parse OpenSSH version, 6.7 is the minimum required
-	reOpenSSH := regexp.MustCompile("OpenSSH_[.0-9]+")
-	reOpenSSHVersion := regexp.MustCompile("[.0-9]+")
-	match := reOpenSSH.Find(sshClient.ServerVersion())
-	openSSHVersionStr := string(reOpenSSHVersion.Find(match))
-	openSSHVersion, err := strconv.ParseFloat(openSSHVersionStr, 64)
+	hostKeys, err := newKnownHosts(knownHostsPath, strictHostKeyChecking)
 	if err != nil {
-		return errors.New("can't parse server OpenSSH version")
+		return nil, err
 	}
-	if openSSHVersion < 6.7 {
-		return errors.New("OpenSSH 6.7 minimum required on server side")
+
+	var sshClient *ssh.Client
+	for _, hop := range hops {
+		sshClient, err = sshDialHop(sshClient, hop, privateKeyPaths, hostKeys)
+		if err != nil {
+			return nil, fmt.Errorf("ssh connection can't be established: %s", err)
+		}
 	}
 
-	// remote addr
-	u, err := url.Parse(remoteAddr)
-	if err != nil {
-		return fmt.Errorf("can't parse remote address: %s", remoteAddr)
+	printDebug("ssh connection established")
+
+	host := newSSHHost(sshClient)
+	host.destination = target.user + "@" + target.addr
+	return host, nil
+}
+
+// sshDialHop establishes an ssh connection to target. If via isn't nil,
+// the connection goes through it (jump host), and via gets closed
+// when the new connection is closed.
+func sshDialHop(via *ssh.Client, target *sshTarget, privateKeyPaths []string, hostKeys *knownHosts) (*ssh.Client, error) {
+	printDebug("user:", target.user)
+
+	// identity files from ssh config are ignored when missing
+	for _, identityFile := range target.identityFiles {
+		if _, err := os.Stat(identityFile); err != nil {
+			printDebug("ignoring identity file from ssh config:", err)
+			continue
+		}
+		privateKeyPaths = append(privateKeyPaths, identityFile)
 	}
 
-	addr := filepath.Join(u.Host, u.Path)
+	ids, err := loadIdentities(privateKeyPaths, !noAgent)
+	if err != nil {
+		return nil, err
+	}
 
-	sshConn, err := sshClient.Dial(u.Scheme, addr)
+	transport, err := transportConfig(target)
 	if err != nil {
-		return fmt.Errorf("can't connect to %s (from remote)", remoteAddr)
+		return nil, err
 	}
 
-	chan1 := make(chan struct{})
-	chan2 := make(chan struct{})
-	chan3 := make(chan struct{})
-	var o sync.Once
-	closeChan2 := func() {
-		close(chan2)
+	config := &ssh.ClientConfig{
+		Config:          transport,
+		User:            target.user,
+		Auth:            []ssh.AuthMethod{authMethodPublicKeys(ids)},
+		HostKeyCallback: hostKeys.HostKeyCallback,
+		Timeout:         sshConnectTimeout,
 	}
 
-	// Copy conn.Reader to sshConn.Writer
-	go func() {
-		printDebug("copy: read from client conn, write to server conn")
-		_, err := io.Copy(sshConn, conn)
-		if err != nil {
-			printFatal(err)
-		}
-		close(chan1)
+	var sshClient *ssh.Client
 
-		if c, ok := sshConn.(ssh.Channel); ok {
-			if err := c.CloseWrite(); err != nil {
-				printError("can't close sshConn writer")
-			} else {
-				printDebug("closed sshConn writer")
-			}
+	if via == nil {
+		printDebug("address:", target.network+"://"+target.addr)
 
+		sshClient, err = ssh.Dial(target.network, target.addr, config)
+		if err != nil {
+			return nil, err
 		}
+	} else {
+		printDebug("address:", target.addr, "(through jump host)")
 
-		for {
-			printDebug("can't read from client anymore, trying to write...")
-			_, err := conn.Write(make([]byte, 0))
-			if err != nil {
-				printDebug("can't write, closing both connections")
-				o.Do(closeChan2)
-				break
-			}
-			time.Sleep(500 * time.Millisecond)
+		conn, err := via.Dial("tcp", target.addr)
+		if err != nil {
+			via.Close()
+			return nil, fmt.Errorf("can't reach %s from jump host: %s", target.addr, err)
 		}
-	}()
-
-	// Copy sshConn.Reader to localConn.Writer
-	go func() {
-		printDebug("copy: read from server conn, write to client conn")
-		_, err := io.Copy(conn, sshConn)
+		c, chans, reqs, err := ssh.NewClientConn(conn, target.addr, config)
 		if err != nil {
-			printFatal(err)
+			via.Close()
+			return nil, err
 		}
-		if tcpConn, ok := conn.(*net.TCPConn); ok {
-			if err := tcpConn.CloseWrite(); err != nil {
-				printError("can't close TCPconn writer")
-			} else {
-				printDebug("closed TCPconn writer")
-			}
-		} else if unixConn, ok := conn.(*net.UnixConn); ok {
-			if err := unixConn.CloseWrite(); err != nil {
-				printError("can't close UnixConn writer")
-			} else {
-				printDebug("closed UnixConn writer")
-			}
-		} else {
-			printDebug("can't close conn writer")
+		sshClient = ssh.NewClient(c, chans, reqs)
+
+		go func() {
+			sshClient.Wait()
+			via.Close()
+		}()
+	}
+
+	if id := usedIdentity(ids); id != nil {
+		printDebug("authenticated on", target.addr, "using", id.source)
+	}
+
+	return sshClient, nil
+}
+
+func handleProxyConnection(conn net.Conn, pool *sshPool, remoteAddr string) {
+	defer conn.Close()
+
+	// messages about the connection can be told apart
+	id := atomic.AddUint64(&connIDs, 1)
+	log := rootLogger.with("conn", id)
+	log.debug("handle connection on", conn.LocalAddr().Network()+"://"+conn.LocalAddr().String())
+
+	// clients are authenticated before anything is forwarded
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			log.error("TLS handshake failed:", err.Error())
+			return
 		}
-		o.Do(closeChan2)
-		close(chan3)
-	}()
+		tlsConn.SetDeadline(time.Time{})
+	}
+
+	sshClient, release, err := pool.Client()
+	if err != nil {
+		log.error("can't forward connection:", err.Error())
+		return
+	}
+	defer release()
 
-	<-chan1
-	<-chan2
-	conn.Close()
-	sshConn.Close()
+	atomic.AddUint64(&totalStreams, 1)
+	atomic.AddInt64(&activeStreams, 1)
+	defer atomic.AddInt64(&activeStreams, -1)
 
-	<-chan3
+	err = forward(log, id, conn, sshClient, remoteAddr)
+	if err != nil {
+		count := atomic.AddUint64(&streamErrors, 1)
+		log.error(fmt.Sprintf("stream error (%d so far):", count), err.Error())
+	}
+}
+
+func forward(log *logger, id uint64, conn net.Conn, host *sshHost, remoteAddr string) error {
 
-	printDebug("closed socket connection")
+	network, addr, err := parseRemoteAddr(remoteAddr)
+	if err != nil {
+		return err
+	}
+
+	sshConn, err := host.dialDocker(log, network, addr)
+	if err != nil {
+		return fmt.Errorf("can't connect to %s (from remote): %s", remoteAddr, err)
+	}
+
+	// Docker API calls are logged, while bytes go through untouched
+	if auditLog != nil {
+		sshConn = newAuditConn(log, id, conn, sshConn, host)
+	}
 
-	return nil
+	err = pipe(log, conn, sshConn, idleTimeout)
+	log.debug("closed socket connection")
+	return err
 }
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aduermael/crypto/ssh"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	// proxied connections log errors on purpose in these tests
+	if !testing.Verbose() {
+		logOutput = ioutil.Discard
+	}
+	os.Exit(m.Run())
+}
+
+// testSSHServer is an in-process ssh server. direct-tcpip and
+// direct-streamlocal channels are connected to an echo backend,
+// whatever address they're opened for.
+type testSSHServer struct {
+	ln      net.Listener
+	config  *ssh.ServerConfig
+	hostKey ssh.PublicKey
+}
+
+func startTestSSHServer(t testing.TB) *testSSHServer {
+	hostKey := newTestSigner(t)
+	config := &ssh.ServerConfig{
+		NoClientAuth: true,
+		// streamlocal channels are only tried with OpenSSH 6.7+
+		ServerVersion: "SSH-2.0-OpenSSH_7.4",
+	}
+	config.AddHostKey(hostKey)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testSSHServer{ln: ln, config: config, hostKey: hostKey.PublicKey()}
+	go s.serve()
+	return s
+}
+
+func (s *testSSHServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *testSSHServer) handle(conn net.Conn) {
+	_, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go func() {
+		for req := range requests {
+			// keepalive@openssh.com...
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}()
+	for newChannel := range channels {
+		switch newChannel.ChannelType() {
+		case "direct-tcpip", "direct-streamlocal@openssh.com":
+			go echoChannel(newChannel)
+		default:
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+// echoChannel sends back what it receives, then closes its write
+// half when the client is done sending
+func echoChannel(newChannel ssh.NewChannel) {
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	defer channel.Close()
+	if _, err := io.Copy(channel, channel); err != nil {
+		return
+	}
+	channel.CloseWrite()
+}
+
+// dial returns a function establishing ssh connections to s,
+// with transport settings from config
+func (s *testSSHServer) dial(config ssh.Config) func() (*sshHost, error) {
+	return func() (*sshHost, error) {
+		client, err := ssh.Dial("tcp", s.ln.Addr().String(), &ssh.ClientConfig{
+			Config: config,
+			User:   "docker",
+			HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				if !keysEqual(key, s.hostKey) {
+					return errHostKeyMismatch
+				}
+				return nil
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return newSSHHost(client), nil
+	}
+}
+
+func (s *testSSHServer) Close() {
+	s.ln.Close()
+}
+
+type testError string
+
+func (e testError) Error() string {
+	return string(e)
+}
+
+const errHostKeyMismatch = testError("host key mismatch")
+
+// startTestTunnel proxies connections accepted on a local tcp listener
+// to remoteAddr, through a pool of size ssh connections to s. It
+// returns the listen address, and a function stopping the tunnel.
+func startTestTunnel(t testing.TB, s *testSSHServer, size int, remoteAddr string, config ssh.Config) (string, func()) {
+	pool, err := newSSHPool(size, s.dial(config), 0, defaultServerAliveCountMax)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := listen("tcp://127.0.0.1:0")
+	if err != nil {
+		pool.Close()
+		t.Fatal(err)
+	}
+	startServing(ln, pool, remoteAddr)
+	return ln.Addr().String(), func() {
+		ln.Close()
+		pool.Close()
+	}
+}
+
+// echoThroughTunnel sends payload through the tunnel listening on addr,
+// and checks it comes back once the write half is closed
+func echoThroughTunnel(addr string, payload []byte) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	sent := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(payload)
+		if err == nil {
+			err = conn.(*net.TCPConn).CloseWrite()
+		}
+		sent <- err
+	}()
+	received, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return err
+	}
+	if err := <-sent; err != nil {
+		return err
+	}
+	if !bytes.Equal(received, payload) {
+		return fmt.Errorf("received %d bytes, %d expected", len(received), len(payload))
+	}
+	return nil
+}
+
+// resetDuringTransfer starts sending data through the tunnel, then
+// resets the connection while data flows in both directions
+func resetDuringTransfer(t *testing.T, addr string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	go conn.Write(make([]byte, 4<<20))
+	if _, err := io.ReadFull(conn, make([]byte, 64<<10)); err != nil {
+		t.Fatal(err)
+	}
+	// RST instead of FIN
+	conn.(*net.TCPConn).SetLinger(0)
+	conn.Close()
+}
+
+func TestTunnelSurvivesClientResets(t *testing.T) {
+	server := startTestSSHServer(t)
+	defer server.Close()
+
+	// direct-tcpip and direct-streamlocal channels
+	for _, remoteAddr := range []string{"tcp://127.0.0.1:2375", "unix:///var/run/docker.sock"} {
+		addr, stop := startTestTunnel(t, server, 1, remoteAddr, ssh.Config{})
+
+		const resets = 5
+		errorsBefore := atomic.LoadUint64(&streamErrors)
+		for i := 0; i < resets; i++ {
+			resetDuringTransfer(t, addr)
+		}
+
+		// errors are counted when proxied streams are done
+		deadline := time.Now().Add(5 * time.Second)
+		for atomic.LoadUint64(&streamErrors)-errorsBefore < resets {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: %d stream errors counted after %d client resets",
+					remoteAddr, atomic.LoadUint64(&streamErrors)-errorsBefore, resets)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if err := echoThroughTunnel(addr, bytes.Repeat([]byte("docker"), 100000)); err != nil {
+			t.Fatal(err)
+		}
+		stop()
+	}
+}
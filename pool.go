@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// sshPool spreads proxied connections over several ssh connections,
+// so that parallel transfers (docker build contexts, image layers...)
+// don't all share one TCP connection and its flow control.
+// Each member is supervised: checked with keepalives and
+// re-established when broken.
+type sshPool struct {
+	members []*poolMember
+}
+
+type poolMember struct {
+	*sshSupervisor
+	// proxied connections currently using this member
+	active int64
+}
+
+// newSSHPool establishes size ssh connections using dial
+func newSSHPool(size int, dial func() (*sshHost, error), aliveInterval time.Duration, aliveCountMax int) (*sshPool, error) {
+	if size < 1 {
+		return nil, errors.New("ssh connection pool size must be at least 1")
+	}
+
+	p := &sshPool{}
+	for i := 0; i < size; i++ {
+		supervisor, err := newSSHSupervisor(dial, aliveInterval, aliveCountMax)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.members = append(p.members, &poolMember{sshSupervisor: supervisor})
+	}
+
+	if size > 1 {
+		printDebug("ssh connections in pool:", size)
+	}
+
+	return p, nil
+}
+
+// Client returns the ssh connection of the least loaded member, among
+// connected ones if possible. release must be called when the proxied
+// connection is done with it.
+func (p *sshPool) Client() (*sshHost, func(), error) {
+	member := p.leastLoaded()
+	atomic.AddInt64(&member.active, 1)
+	release := func() {
+		atomic.AddInt64(&member.active, -1)
+	}
+
+	host, err := member.Client()
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return host, release, nil
+}
+
+// leastLoaded returns the connected member with the fewest active
+// connections. If none is connected, members being re-established
+// are considered as well.
+func (p *sshPool) leastLoaded() *poolMember {
+	var best *poolMember
+	bestConnected := false
+	for _, member := range p.members {
+		state, _ := member.State()
+		connected := state == connStateConnected
+		if best == nil || (connected && !bestConnected) ||
+			(connected == bestConnected && atomic.LoadInt64(&member.active) < atomic.LoadInt64(&best.active)) {
+			best = member
+			bestConnected = connected
+		}
+	}
+	return best
+}
+
+// States returns the state of each ssh connection
+func (p *sshPool) States() []string {
+	states := make([]string, 0, len(p.members))
+	for _, member := range p.members {
+		state, _ := member.State()
+		states = append(states, state)
+	}
+	return states
+}
+
+// Close closes all ssh connections
+func (p *sshPool) Close() error {
+	var err error
+	for _, member := range p.members {
+		if e := member.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aduermael/crypto/ssh"
+)
+
+func TestLeastLoadedSkipsDisconnectedMembers(t *testing.T) {
+	member := func(state string, active int64) *poolMember {
+		return &poolMember{sshSupervisor: &sshSupervisor{state: state}, active: active}
+	}
+
+	tests := []struct {
+		members  []*poolMember
+		expected int
+	}{
+		{
+			members: []*poolMember{
+				member(connStateReconnecting, 0),
+				member(connStateConnected, 3),
+				member(connStateUnresponsive, 0),
+				member(connStateConnected, 1),
+			},
+			expected: 3,
+		},
+		{
+			members: []*poolMember{
+				member(connStateClosed, 0),
+				member(connStateConnected, 5),
+			},
+			expected: 1,
+		},
+		// when none is connected, the least loaded is used
+		{
+			members: []*poolMember{
+				member(connStateReconnecting, 2),
+				member(connStateUnresponsive, 1),
+			},
+			expected: 1,
+		},
+	}
+
+	for i, test := range tests {
+		pool := &sshPool{members: test.members}
+		if member := pool.leastLoaded(); member != test.members[test.expected] {
+			state, _ := member.State()
+			t.Errorf("%d: got %s member with %d active connections, member %d expected",
+				i, state, member.active, test.expected)
+		}
+	}
+}
+
+// BenchmarkPool measures throughput of parallel transfers going
+// through one ssh connection, or spread over several
+func BenchmarkPool(b *testing.B) {
+	for _, size := range []int{1, 4} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			benchmarkTunnel(b, size, ssh.Config{})
+		})
+	}
+}
+
+// benchmarkTunnel echoes 1MB payloads through a tunnel to an in-process
+// ssh server, from parallel connections
+func benchmarkTunnel(b *testing.B, poolSize int, config ssh.Config) {
+	server := startTestSSHServer(b)
+	defer server.Close()
+	addr, stop := startTestTunnel(b, server, poolSize, "unix:///var/run/docker.sock", config)
+	defer stop()
+
+	payload := make([]byte, 1<<20)
+	b.SetBytes(int64(len(payload)))
+	b.SetParallelism(4)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := echoThroughTunnel(addr, payload); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
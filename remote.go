@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aduermael/crypto/ssh"
+)
+
+const (
+	// used when the remote Docker endpoint can't be detected
+	defaultRemoteDockerAddr = "unix:///var/run/docker.sock"
+)
+
+// detectDockerScript prints the remote Docker endpoint: $DOCKER_HOST
+// if set, otherwise the first Docker or Podman socket found.
+// It must not contain single quotes.
+const detectDockerScript = `
+if [ -n "$DOCKER_HOST" ]; then
+	echo "$DOCKER_HOST"
+	exit 0
+fi
+for s in "$XDG_RUNTIME_DIR/docker.sock" /var/run/docker.sock /run/docker.sock \
+	"/run/user/$(id -u)/docker.sock" "$XDG_RUNTIME_DIR/podman/podman.sock" \
+	"/run/user/$(id -u)/podman/podman.sock" /run/podman/podman.sock; do
+	if [ -S "$s" ]; then
+		echo "unix://$s"
+		exit 0
+	fi
+done
+`
+
+// parseRemoteAddr parses a unix:// or tcp:// Docker endpoint URL and
+// returns network and address to be used with ssh.Client.Dial
+func parseRemoteAddr(remoteAddr string) (string, string, error) {
+	u, err := url.Parse(remoteAddr)
+	if err != nil {
+		return "", "", fmt.Errorf("can't parse remote address: %s", remoteAddr)
+	}
+
+	switch u.Scheme {
+	case "unix":
+		if u.Path == "" {
+			return "", "", fmt.Errorf("missing socket path in remote address: %s", remoteAddr)
+		}
+		return "unix", u.Path, nil
+	case "tcp":
+		if u.Host == "" {
+			return "", "", fmt.Errorf("missing host in remote address: %s", remoteAddr)
+		}
+		if u.Port() == "" {
+			return "", "", fmt.Errorf("missing port in remote address: %s", remoteAddr)
+		}
+		return "tcp", u.Host, nil
+	default:
+		return "", "", fmt.Errorf("unsupported remote address: %s (unix:// or tcp:// expected)", remoteAddr)
+	}
+}
+
+// detectRemoteDockerAddr asks the remote host where the Docker daemon
+// can be reached, through an exec session. Default address is returned
+// if the session can't be opened or nothing usable is found.
+func detectRemoteDockerAddr(sshClient *ssh.Client) string {
+	session, err := sshClient.NewSession()
+	if err != nil {
+		printDebug("can't open session to detect remote Docker endpoint:", err)
+		return defaultRemoteDockerAddr
+	}
+	defer session.Close()
+
+	// remote login shell may not be POSIX compliant
+	output, err := session.Output("sh -c '" + detectDockerScript + "'")
+	if err != nil {
+		printDebug("can't detect remote Docker endpoint:", err)
+		return defaultRemoteDockerAddr
+	}
+
+	remoteAddr := strings.TrimSpace(string(output))
+	if remoteAddr == "" {
+		printDebug("no Docker socket found on remote host")
+		return defaultRemoteDockerAddr
+	}
+	if _, _, err := parseRemoteAddr(remoteAddr); err != nil {
+		// DOCKER_HOST can use schemes we don't support (ssh://, fd://...)
+		printDebug("ignoring detected remote Docker endpoint:", err)
+		return defaultRemoteDockerAddr
+	}
+
+	return remoteAddr
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// how long proxied streams are waited for when shutting down
+	defaultShutdownTimeout = 30 * time.Second
+)
+
+var (
+	// set when shutting down: listeners are closed on purpose
+	shuttingDown int32
+	// serve loops, and the connections they accepted
+	serving sync.WaitGroup
+	streams sync.WaitGroup
+)
+
+// shutdownSignals returns a channel receiving signals asking
+// docker-tunnel to shut down
+func shutdownSignals() chan os.Signal {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	return signals
+}
+
+// drain stops accepting connections on listeners (unix sockets get
+// removed), then waits for proxied streams to finish, for at most
+// timeout. It returns right away when another shutdown signal is
+// received. Streams still active when it returns are cut when ssh
+// connections get closed.
+func drain(listeners []net.Listener, timeout time.Duration, signals <-chan os.Signal) {
+	atomic.StoreInt32(&shuttingDown, 1)
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	// no new stream can be accepted once serve loops are done
+	serving.Wait()
+
+	drained := make(chan struct{})
+	go func() {
+		streams.Wait()
+		close(drained)
+	}()
+
+	if active := atomic.LoadInt64(&activeStreams); active > 0 {
+		print(fmt.Sprintf("waiting for %d active streams to finish (up to %s, interrupt again to force)", active, timeout))
+	}
+
+	select {
+	case <-drained:
+		printDebug("all streams done")
+	case <-time.After(timeout):
+		print(fmt.Sprintf("shutdown timeout, closing %d active streams", atomic.LoadInt64(&activeStreams)))
+	case sig := <-signals:
+		print(fmt.Sprintf("forced shutdown (%s), closing %d active streams", sig, atomic.LoadInt64(&activeStreams)))
+	}
+}
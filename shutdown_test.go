@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aduermael/crypto/ssh"
+)
+
+func TestDrainWaitsForStreams(t *testing.T) {
+	server := startTestSSHServer(t)
+	defer server.Close()
+
+	pool, err := newSSHPool(1, server.dial(ssh.Config{}), 0, defaultServerAliveCountMax)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	ln, err := listen("tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	startServing(ln, pool, "tcp://127.0.0.1:2375")
+	defer atomic.StoreInt32(&shuttingDown, 0)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	// the stream is proxied once the echo comes back
+	if _, err := conn.Write([]byte("docker")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 6)); err != nil {
+		t.Fatal(err)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		drain([]net.Listener{ln}, 10*time.Second, nil)
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		t.Fatal("drain returned with an active stream")
+	case <-time.After(200 * time.Millisecond):
+	}
+	if _, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		t.Error("connection accepted while draining")
+	}
+
+	conn.Close()
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain still waiting after the stream ended")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// exit hooks are run before docker-tunnel exits because of
+// an error (printFatal) or a signal (exitOnSignals), since
+// deferred functions don't run in these cases
+var (
+	exitHooksMu sync.Mutex
+	exitHooks   []func()
+)
+
+// addExitHook registers f to be run before exiting
+func addExitHook(f func()) {
+	exitHooksMu.Lock()
+	defer exitHooksMu.Unlock()
+	exitHooks = append(exitHooks, f)
+}
+
+// runExitHooks runs exit hooks in reverse order of registration,
+// only once
+func runExitHooks() {
+	exitHooksMu.Lock()
+	hooks := exitHooks
+	exitHooks = nil
+	exitHooksMu.Unlock()
+
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i]()
+	}
+}
+
+// exitOnSignals runs exit hooks and exits when docker-tunnel is
+// interrupted, terminated or hung up, with the status a shell would
+// report (128+n for signal n)
+func exitOnSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		sig := <-signals
+		printDebug("exiting on signal:", sig)
+		runExitHooks()
+		os.Exit(128 + int(sig.(syscall.Signal)))
+	}()
+}
@@ -1,14 +1,14 @@
 package main
 
 import (
-	"crypto/rsa"
 	"crypto/x509"
-	"encoding/pem"
-	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
 	"os/user"
 	"path/filepath"
+	"strings"
 
 	"github.com/aduermael/crypto/ssh"
 	"github.com/howeyc/gopass"
@@ -16,67 +16,224 @@ import (
 
 const (
 	errCannotDecodeEncryptedPrivateKeys = "ssh: cannot decode encrypted private keys"
+	// number of times the password of an encrypted key can be entered
+	passwordAttempts = 3
 )
 
-// authMethodPublicKeys returns an ssh.PublicKeys authentication
-// method using private key path.
-// If privateKeyPath is empty, default location used: ~/.ssh/id_rsa
-func authMethodPublicKeys(privateKeyPath string) (ssh.AuthMethod, error) {
+var (
+	// private keys tried when no identity file is given,
+	// in the same order as OpenSSH
+	defaultIdentityFiles = []string{"id_ed25519", "id_ecdsa", "id_rsa", "id_dsa"}
+	// signers already loaded, by private key path, so that passwords
+	// are only requested once when connecting to several hosts
+	loadedSigners = map[string]ssh.Signer{}
+)
+
+// identity is a signer along with a description of where
+// it comes from, used in debug logs
+type identity struct {
+	ssh.Signer
+	source string
+	// signed is set when the signer has been used, which means
+	// the server accepted its public key
+	signed bool
+}
+
+func (id *identity) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	printDebug("server accepts", id.source)
+	id.signed = true
+	return id.Signer.Sign(rand, data)
+}
+
+// loadIdentities returns keys held by ssh-agent (if useAgent is true),
+// followed by private keys stored at privateKeyPaths, in order.
+// If privateKeyPaths is empty, OpenSSH default keys found in ~/.ssh
+// are used instead.
+func loadIdentities(privateKeyPaths []string, useAgent bool) ([]*identity, error) {
+	ids := make([]*identity, 0)
 
-	if privateKeyPath == "" {
-		usr, err := user.Current()
+	if useAgent {
+		agentKeys, err := agentSigners()
 		if err != nil {
-			return nil, err
+			// not fatal, private key files may still be accepted
+			printDebug(err)
+		}
+		for _, signer := range agentKeys {
+			source := "ssh-agent key " + signer.PublicKey().Type() + " " + ssh.FingerprintSHA256(signer.PublicKey())
+			ids = append(ids, &identity{Signer: signer, source: source})
 		}
-		privateKeyPath = filepath.Join(usr.HomeDir, ".ssh", "id_rsa")
 	}
 
-	pemBytes, err := ioutil.ReadFile(privateKeyPath)
+	if len(privateKeyPaths) > 0 {
+		for _, privateKeyPath := range privateKeyPaths {
+			signer, err := signerFromFile(privateKeyPath)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, &identity{Signer: signer, source: privateKeyPath})
+		}
+		return ids, nil
+	}
+
+	usr, err := user.Current()
 	if err != nil {
 		return nil, err
 	}
+	ids = append(ids, defaultIdentities(filepath.Join(usr.HomeDir, ".ssh"))...)
 
-	key, err := ssh.ParseRawPrivateKey(pemBytes)
-	if err != nil {
-		if err.Error() == errCannotDecodeEncryptedPrivateKeys {
-			// private key is encrypted, try to decrypt it
-			// prompt user for ssh key password
-			fmt.Printf("Enter password for private key (%s): ", privateKeyPath)
-			var passwordInput []byte
-			passwordInput, err = gopass.GetPasswd()
-			if err != nil {
-				return nil, err
-			}
-			key, err = decryptPrivateKey(pemBytes, passwordInput)
-			if err != nil {
-				return nil, err
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no ssh identity found (looked for %s in %s and ssh-agent)",
+			strings.Join(defaultIdentityFiles, ", "), filepath.Join(usr.HomeDir, ".ssh"))
+	}
+
+	return ids, nil
+}
+
+// defaultIdentities returns OpenSSH default keys found in sshDir.
+// Like OpenSSH, keys that can't be loaded (unsupported type or
+// format...) are skipped rather than aborting authentication.
+func defaultIdentities(sshDir string) []*identity {
+	ids := make([]*identity, 0)
+	for _, name := range defaultIdentityFiles {
+		privateKeyPath := filepath.Join(sshDir, name)
+		signer, err := signerFromFile(privateKeyPath)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				printDebug(fmt.Sprintf("ignoring %s: %s", privateKeyPath, err))
 			}
-		} else {
-			return nil, err
+			continue
+		}
+		printDebug("found private key:", privateKeyPath)
+		ids = append(ids, &identity{Signer: signer, source: privateKeyPath})
+	}
+	return ids
+}
+
+// authMethodPublicKeys returns an ssh.PublicKeys authentication
+// method trying each identity in order
+func authMethodPublicKeys(ids []*identity) ssh.AuthMethod {
+	signers := make([]ssh.Signer, len(ids))
+	for i, id := range ids {
+		signers[i] = id
+	}
+	return ssh.PublicKeys(signers...)
+}
+
+// usedIdentity returns the identity that has been used to
+// authenticate, or nil if none has been used
+func usedIdentity(ids []*identity) *identity {
+	for _, id := range ids {
+		if id.signed {
+			return id
 		}
 	}
+	return nil
+}
 
-	signer, err := ssh.NewSignerFromKey(key)
+// signerFromFile returns a signer for the private key stored at
+// privateKeyPath. If the key is encrypted and its public key can
+// be found next to it (.pub), the password is only requested when
+// the server accepts the key.
+func signerFromFile(privateKeyPath string) (ssh.Signer, error) {
+	if signer, ok := loadedSigners[privateKeyPath]; ok {
+		return signer, nil
+	}
+	signer, err := loadSignerFromFile(privateKeyPath)
 	if err != nil {
 		return nil, err
 	}
-
-	return ssh.PublicKeys(signer), nil
+	loadedSigners[privateKeyPath] = signer
+	return signer, nil
 }
 
-// decryptPrivateKey decryps a private key using provided password
-func decryptPrivateKey(pemBytes []byte, password []byte) (*rsa.PrivateKey, error) {
-	block, rest := pem.Decode(pemBytes)
-	if len(rest) > 0 {
-		return nil, errors.New("extra data included in key")
+func loadSignerFromFile(privateKeyPath string) (ssh.Signer, error) {
+	pemBytes, err := ioutil.ReadFile(privateKeyPath)
+	if err != nil {
+		return nil, err
 	}
-	der, err := x509.DecryptPEMBlock(block, password)
+
+	key, err := ssh.ParseRawPrivateKey(pemBytes)
 	if err != nil {
-		return nil, fmt.Errorf("decrypt failed: %v", err)
+		if err.Error() != errCannotDecodeEncryptedPrivateKeys {
+			return nil, err
+		}
+		// private key is encrypted
+		pub, err := readPublicKey(privateKeyPath + ".pub")
+		if err == nil {
+			return &encryptedKeySigner{path: privateKeyPath, pemBytes: pemBytes, pub: pub}, nil
+		}
+		key, err = promptAndDecryptPrivateKey(privateKeyPath, pemBytes)
+		if err != nil {
+			return nil, err
+		}
 	}
-	key, err := x509.ParsePKCS1PrivateKey(der)
+
+	return ssh.NewSignerFromKey(key)
+}
+
+// promptAndDecryptPrivateKey prompts user for ssh key password
+// and uses it to decrypt the private key.
+// User can try again when the password is incorrect.
+func promptAndDecryptPrivateKey(privateKeyPath string, pemBytes []byte) (interface{}, error) {
+	for attempt := 1; ; attempt++ {
+		fmt.Fprintf(os.Stderr, "Enter password for private key (%s): ", privateKeyPath)
+		passwordInput, err := gopass.GetPasswd()
+		if err != nil {
+			return nil, err
+		}
+		key, err := decryptPrivateKey(pemBytes, passwordInput)
+		if err == x509.IncorrectPasswordError && attempt < passwordAttempts {
+			fmt.Fprintln(os.Stderr, "Incorrect password, try again.")
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decrypt failed: %v", err)
+		}
+		return key, nil
+	}
+}
+
+// readPublicKey reads a public key in authorized_keys format
+func readPublicKey(path string) (ssh.PublicKey, error) {
+	content, err := ioutil.ReadFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("decrypt failed: %v", err)
+		return nil, err
 	}
-	return key, nil
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(content)
+	return pub, err
+}
+
+// encryptedKeySigner is a signer for an encrypted private key
+// which public key is known. The key is only decrypted when
+// a signature is needed.
+type encryptedKeySigner struct {
+	path     string
+	pemBytes []byte
+	pub      ssh.PublicKey
+	signer   ssh.Signer
+}
+
+func (s *encryptedKeySigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *encryptedKeySigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	if s.signer == nil {
+		key, err := promptAndDecryptPrivateKey(s.path, s.pemBytes)
+		if err != nil {
+			return nil, err
+		}
+		s.signer, err = ssh.NewSignerFromKey(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s.signer.Sign(rand, data)
+}
+
+// decryptPrivateKey decrypts a private key using provided password.
+// RSA, ECDSA and DSA keys encrypted in PEM format are supported,
+// as well as RSA, ECDSA and ed25519 keys in OpenSSH format.
+func decryptPrivateKey(pemBytes []byte, password []byte) (interface{}, error) {
+	return ssh.ParseRawPrivateKeyWithPassphrase(pemBytes, password)
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDefaultIdentitiesSkipsUnloadableKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{
+		// PKCS#8 block type, not supported
+		"id_ed25519": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: ecDER}),
+		"id_ecdsa":   pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}),
+		"id_rsa":     []byte("not a private key\n"),
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids := defaultIdentities(dir)
+	if len(ids) != 1 || ids[0].source != filepath.Join(dir, "id_ecdsa") {
+		t.Fatalf("unexpected identities: %v", ids)
+	}
+
+	// explicit identity files have to be loaded
+	if _, err := loadIdentities([]string{filepath.Join(dir, "id_ed25519")}, false); err == nil {
+		t.Error("unsupported identity file accepted")
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// value of -F flag to ignore ssh config files
+	sshConfigNone = "none"
+	// maximum Include recursion depth, same as OpenSSH
+	sshConfigMaxIncludeDepth = 16
+)
+
+// sshConfig is a parsed ssh_config(5) file.
+// Only the options docker-tunnel understands are kept,
+// others are silently ignored.
+type sshConfig struct {
+	blocks []*sshConfigBlock
+}
+
+// sshConfigBlock is a set of options that apply when
+// a Host or Match condition is satisfied
+type sshConfigBlock struct {
+	// Host patterns, nil for Match blocks
+	hostPatterns []string
+	// Match criteria, as pairs of criterion and argument
+	// ("all" has an empty argument)
+	matchCriteria [][2]string
+	options       [][2]string
+}
+
+// sshHostConfig contains resolved options for one host
+type sshHostConfig struct {
+	HostName            string
+	User                string
+	Port                string
+	IdentityFiles       []string
+	ProxyJump           string
+	ServerAliveInterval time.Duration
+	// ServerAliveInterval can be explicitly set to 0
+	ServerAliveIntervalSet bool
+	ServerAliveCountMax    int
+	// algorithm lists, in OpenSSH syntax
+	Ciphers       string
+	KexAlgorithms string
+	MACs          string
+}
+
+// defaultSSHConfigPath returns ~/.ssh/config
+func defaultSSHConfigPath() (string, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(usr.HomeDir, ".ssh", "config"), nil
+}
+
+// loadSSHConfig parses the ssh config file at path.
+// If path is empty, ~/.ssh/config is used, and it's not an error
+// if it doesn't exist. If path is "none", an empty config is returned.
+func loadSSHConfig(path string) (*sshConfig, error) {
+	config := &sshConfig{}
+
+	if path == sshConfigNone {
+		return config, nil
+	}
+
+	if path == "" {
+		defaultPath, err := defaultSSHConfigPath()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(defaultPath); os.IsNotExist(err) {
+			printDebug("no ssh config file found at", defaultPath)
+			return config, nil
+		}
+		path = defaultPath
+	}
+
+	// options before the first Host or Match line apply to all hosts
+	config.blocks = append(config.blocks, &sshConfigBlock{hostPatterns: []string{"*"}})
+
+	if err := config.parseFile(path, 0); err != nil {
+		return nil, err
+	}
+
+	printDebug("ssh config file:", path)
+
+	return config, nil
+}
+
+// parseFile parses config lines from path, appending options
+// to the last block. Include directives are processed as if
+// included files content was inserted in place.
+func (c *sshConfig) parseFile(path string, depth int) error {
+	if depth > sshConfigMaxIncludeDepth {
+		return fmt.Errorf("ssh config: too many levels of Include (%s)", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+
+		keyword, args, err := splitSSHConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s line %d: %s", path, lineNumber, err)
+		}
+		if keyword == "" {
+			continue
+		}
+		if len(args) == 0 {
+			return fmt.Errorf("%s line %d: missing argument for %s", path, lineNumber, keyword)
+		}
+
+		switch keyword {
+		case "host":
+			c.blocks = append(c.blocks, &sshConfigBlock{hostPatterns: args})
+		case "match":
+			criteria, err := parseMatchCriteria(args)
+			if err != nil {
+				return fmt.Errorf("%s line %d: %s", path, lineNumber, err)
+			}
+			c.blocks = append(c.blocks, &sshConfigBlock{matchCriteria: criteria})
+		case "include":
+			for _, pattern := range args {
+				if err := c.include(pattern, depth+1); err != nil {
+					return err
+				}
+			}
+		default:
+			block := c.blocks[len(c.blocks)-1]
+			for _, arg := range args {
+				block.options = append(block.options, [2]string{keyword, arg})
+			}
+		}
+	}
+
+	return scanner.Err()
+}
+
+// include parses files matching pattern, relative
+// paths being relative to ~/.ssh
+func (c *sshConfig) include(pattern string, depth int) error {
+	pattern = expandHomeDir(pattern)
+	if !filepath.IsAbs(pattern) {
+		usr, err := user.Current()
+		if err != nil {
+			return err
+		}
+		pattern = filepath.Join(usr.HomeDir, ".ssh", pattern)
+	}
+
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := c.parseFile(path, depth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve returns options for host, which can be an alias
+// defined by a Host line. As with OpenSSH, the first obtained
+// value for each option is used, except for IdentityFile
+// values that are all kept, in order.
+func (c *sshConfig) resolve(host, remoteUser string) (*sshHostConfig, error) {
+	hostConfig := &sshHostConfig{}
+
+	for _, block := range c.blocks {
+		// Match host criteria are evaluated against HostName
+		// when it has already been set
+		hostname := host
+		if hostConfig.HostName != "" {
+			hostname = hostConfig.HostName
+		}
+		if !block.matches(hostname, host, remoteUser) {
+			continue
+		}
+
+		for _, option := range block.options {
+			keyword, value := option[0], option[1]
+			switch keyword {
+			case "hostname":
+				if hostConfig.HostName == "" {
+					hostConfig.HostName = strings.Replace(value, "%h", host, -1)
+				}
+			case "user":
+				if hostConfig.User == "" {
+					hostConfig.User = value
+				}
+			case "port":
+				if hostConfig.Port == "" {
+					if _, err := strconv.ParseUint(value, 10, 16); err != nil {
+						return nil, fmt.Errorf("ssh config: bad port number: %s", value)
+					}
+					hostConfig.Port = value
+				}
+			case "identityfile":
+				hostConfig.IdentityFiles = append(hostConfig.IdentityFiles, value)
+			case "proxyjump":
+				if hostConfig.ProxyJump == "" {
+					hostConfig.ProxyJump = value
+				}
+			case "serveraliveinterval":
+				if !hostConfig.ServerAliveIntervalSet {
+					seconds, err := strconv.Atoi(value)
+					if err != nil || seconds < 0 {
+						return nil, fmt.Errorf("ssh config: bad ServerAliveInterval: %s", value)
+					}
+					hostConfig.ServerAliveInterval = time.Duration(seconds) * time.Second
+					hostConfig.ServerAliveIntervalSet = true
+				}
+			case "ciphers":
+				if hostConfig.Ciphers == "" {
+					hostConfig.Ciphers = value
+				}
+			case "kexalgorithms":
+				if hostConfig.KexAlgorithms == "" {
+					hostConfig.KexAlgorithms = value
+				}
+			case "macs":
+				if hostConfig.MACs == "" {
+					hostConfig.MACs = value
+				}
+			case "serveralivecountmax":
+				if hostConfig.ServerAliveCountMax == 0 {
+					count, err := strconv.Atoi(value)
+					if err != nil || count < 1 {
+						return nil, fmt.Errorf("ssh config: bad ServerAliveCountMax: %s", value)
+					}
+					hostConfig.ServerAliveCountMax = count
+				}
+			}
+		}
+	}
+
+	if hostConfig.HostName == "" {
+		hostConfig.HostName = host
+	}
+	if hostConfig.ProxyJump == sshConfigNone {
+		hostConfig.ProxyJump = ""
+	}
+
+	// tokens in identity files are expanded once all values are known
+	for i, identityFile := range hostConfig.IdentityFiles {
+		hostConfig.IdentityFiles[i] = expandSSHConfigTokens(identityFile, hostConfig, remoteUser)
+	}
+
+	return hostConfig, nil
+}
+
+// matches returns true if block's options apply to the host
+func (b *sshConfigBlock) matches(hostname, originalHost, remoteUser string) bool {
+	if b.matchCriteria == nil {
+		return matchPatternList(b.hostPatterns, originalHost)
+	}
+
+	for _, criterion := range b.matchCriteria {
+		switch criterion[0] {
+		case "all":
+		case "host":
+			if !matchPatternList(strings.Split(criterion[1], ","), hostname) {
+				return false
+			}
+		case "originalhost":
+			if !matchPatternList(strings.Split(criterion[1], ","), originalHost) {
+				return false
+			}
+		case "user":
+			if remoteUser == "" || !matchPatternList(strings.Split(criterion[1], ","), remoteUser) {
+				return false
+			}
+		default:
+			// exec, localuser, canonical... are not supported
+			printDebug("ssh config: unsupported Match criterion:", criterion[0])
+			return false
+		}
+	}
+	return true
+}
+
+// matchPatternList returns true if s matches at least one of the
+// patterns and none of the negated (!pattern) ones
+func matchPatternList(patterns []string, s string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		if negated {
+			pattern = pattern[1:]
+		}
+		if !matchWildcard(strings.ToLower(pattern), strings.ToLower(s)) {
+			continue
+		}
+		if negated {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// parseMatchCriteria parses arguments of a Match line
+func parseMatchCriteria(args []string) ([][2]string, error) {
+	criteria := make([][2]string, 0)
+	for i := 0; i < len(args); i++ {
+		criterion := strings.ToLower(args[i])
+		if criterion == "all" {
+			criteria = append(criteria, [2]string{criterion, ""})
+			continue
+		}
+		if i+1 >= len(args) {
+			return nil, fmt.Errorf("missing argument for Match %s", args[i])
+		}
+		criteria = append(criteria, [2]string{criterion, args[i+1]})
+		i++
+	}
+	return criteria, nil
+}
+
+// splitSSHConfigLine returns lowercased keyword and arguments of
+// a config line. Keyword and arguments can be separated by
+// whitespace or a single '='. Arguments can be double quoted.
+// An empty keyword is returned for blank lines and comments.
+func splitSSHConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil, nil
+	}
+
+	end := strings.IndexAny(line, " \t=")
+	if end == -1 {
+		return strings.ToLower(line), nil, nil
+	}
+	keyword := strings.ToLower(line[:end])
+	rest := strings.TrimSpace(line[end:])
+	rest = strings.TrimSpace(strings.TrimPrefix(rest, "="))
+
+	args := make([]string, 0)
+	for rest != "" {
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end == -1 {
+				return "", nil, errors.New("unterminated quoted argument")
+			}
+			args = append(args, rest[1:end+1])
+			rest = strings.TrimSpace(rest[end+2:])
+			continue
+		}
+		end := strings.IndexAny(rest, " \t")
+		if end == -1 {
+			end = len(rest)
+		}
+		if strings.HasPrefix(rest[:end], "#") {
+			break
+		}
+		args = append(args, rest[:end])
+		rest = strings.TrimSpace(rest[end:])
+	}
+
+	return keyword, args, nil
+}
+
+// expandSSHConfigTokens expands ~ and the following tokens:
+// %d (local home directory), %u (local user), %h (remote host),
+// %r (remote user), %p (remote port) and %%.
+func expandSSHConfigTokens(s string, hostConfig *sshHostConfig, remoteUser string) string {
+	s = expandHomeDir(s)
+	if !strings.Contains(s, "%") {
+		return s
+	}
+
+	home, localUser := "", ""
+	if usr, err := user.Current(); err == nil {
+		home, localUser = usr.HomeDir, usr.Username
+	}
+	if hostConfig.User != "" && remoteUser == "" {
+		remoteUser = hostConfig.User
+	}
+	port := hostConfig.Port
+	if port == "" {
+		port = "22"
+	}
+
+	replacer := strings.NewReplacer(
+		"%%", "%",
+		"%d", home,
+		"%u", localUser,
+		"%h", hostConfig.HostName,
+		"%r", remoteUser,
+		"%p", port,
+	)
+	return replacer.Replace(s)
+}
+
+// expandHomeDir replaces a leading ~ with user's home directory
+func expandHomeDir(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	usr, err := user.Current()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(usr.HomeDir, path[1:])
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// writeSSHConfig writes content to a file named name in dir,
+// and returns its path
+func writeSSHConfig(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSSHConfigResolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh_config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	usr, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		config     string
+		host       string
+		remoteUser string
+		want       sshHostConfig
+	}{
+		{
+			name: "first value wins, identity files accumulate",
+			config: `Host prod
+  HostName prod.example.com
+  User deploy
+  IdentityFile ~/.ssh/prod
+Host *
+  HostName other.example.com
+  User root
+  Port 2222
+  IdentityFile ~/.ssh/id_ed25519
+`,
+			host: "prod",
+			want: sshHostConfig{
+				HostName: "prod.example.com",
+				User:     "deploy",
+				Port:     "2222",
+				IdentityFiles: []string{
+					filepath.Join(usr.HomeDir, ".ssh", "prod"),
+					filepath.Join(usr.HomeDir, ".ssh", "id_ed25519"),
+				},
+			},
+		},
+		{
+			name: "negated host pattern",
+			config: `Host *.example.com !bastion.example.com
+  User deploy
+`,
+			host: "bastion.example.com",
+			want: sshHostConfig{HostName: "bastion.example.com"},
+		},
+		{
+			name: "host pattern with a negation",
+			config: `Host *.example.com !bastion.example.com
+  User deploy
+`,
+			host: "web.example.com",
+			want: sshHostConfig{HostName: "web.example.com", User: "deploy"},
+		},
+		{
+			name: "Match host evaluated against HostName",
+			config: `Host prod
+  HostName prod.internal
+Match host prod
+  ProxyJump bastion
+Match host *.internal
+  User admin
+Match originalhost prod
+  Port 2200
+`,
+			host: "prod",
+			want: sshHostConfig{HostName: "prod.internal", User: "admin", Port: "2200"},
+		},
+		{
+			name: "Match user",
+			config: `Match user admin
+  Port 2200
+`,
+			host:       "prod",
+			remoteUser: "admin",
+			want:       sshHostConfig{HostName: "prod", Port: "2200"},
+		},
+		{
+			name: "quoted arguments and key=value syntax",
+			config: `Host = prod
+  User=deploy
+  Port = 2222
+  IdentityFile "~/.ssh/my key"
+  Ciphers aes128-ctr # comment
+`,
+			host: "prod",
+			want: sshHostConfig{
+				HostName:      "prod",
+				User:          "deploy",
+				Port:          "2222",
+				IdentityFiles: []string{filepath.Join(usr.HomeDir, ".ssh", "my key")},
+				Ciphers:       "aes128-ctr",
+			},
+		},
+		{
+			name: "tokens",
+			config: `Host *.short
+  HostName %h.example.com
+  User admin
+  Port 2222
+  IdentityFile /keys/%h_%r_%p_%%
+`,
+			host: "prod.short",
+			want: sshHostConfig{
+				HostName:      "prod.short.example.com",
+				User:          "admin",
+				Port:          "2222",
+				IdentityFiles: []string{"/keys/prod.short.example.com_admin_2222_%"},
+			},
+		},
+		{
+			name: "tokens with remote user",
+			config: `Host prod
+  User admin
+  IdentityFile /keys/%h_%r_%p
+`,
+			host:       "prod",
+			remoteUser: "ops",
+			want: sshHostConfig{
+				HostName:      "prod",
+				User:          "admin",
+				IdentityFiles: []string{"/keys/prod_ops_22"},
+			},
+		},
+		{
+			name: "ProxyJump none",
+			config: `Host internal
+  ProxyJump none
+Host *
+  ProxyJump bastion
+`,
+			host: "internal",
+			want: sshHostConfig{HostName: "internal"},
+		},
+		{
+			name: "ProxyJump",
+			config: `Host internal
+  ProxyJump none
+Host *
+  ProxyJump bastion
+`,
+			host: "external",
+			want: sshHostConfig{HostName: "external", ProxyJump: "bastion"},
+		},
+	}
+
+	for i, test := range tests {
+		path := writeSSHConfig(t, dir, "config"+strconv.Itoa(i), test.config)
+		config, err := loadSSHConfig(path)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		hostConfig, err := config.resolve(test.host, test.remoteUser)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(*hostConfig, test.want) {
+			t.Errorf("%s:\ngot  %+v\nwant %+v", test.name, *hostConfig, test.want)
+		}
+	}
+}
+
+func TestSSHConfigInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh_config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	usr, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeSSHConfig(t, dir, "prod.conf", "Host prod\n  User deploy\n")
+	writeSSHConfig(t, dir, "staging.conf", "Host staging\n  User ci\n")
+
+	// relative paths are relative to ~/.ssh
+	pattern, err := filepath.Rel(filepath.Join(usr.HomeDir, ".ssh"), filepath.Join(dir, "*.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeSSHConfig(t, dir, "config", "Include "+pattern+"\nHost *\n  User root\n")
+
+	config, err := loadSSHConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]string{"prod": "deploy", "staging": "ci", "other": "root"} {
+		hostConfig, err := config.resolve(host, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hostConfig.User != want {
+			t.Errorf("%s: user %q, %q expected", host, hostConfig.User, want)
+		}
+	}
+
+	// recursion is limited
+	loop := filepath.Join(dir, "loop")
+	writeSSHConfig(t, dir, "loop", "Include "+loop+"\n")
+	if _, err := loadSSHConfig(loop); err == nil || !strings.Contains(err.Error(), "too many levels of Include") {
+		t.Errorf("recursive Include: got error %v", err)
+	}
+}
+
+func TestSplitSSHConfigLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		keyword string
+		args    []string
+		err     bool
+	}{
+		{line: "", keyword: ""},
+		{line: "  # comment", keyword: ""},
+		{line: "HostName example.com", keyword: "hostname", args: []string{"example.com"}},
+		{line: "\tUser\tdeploy  ", keyword: "user", args: []string{"deploy"}},
+		{line: "Port=2222", keyword: "port", args: []string{"2222"}},
+		{line: "Port = 2222", keyword: "port", args: []string{"2222"}},
+		{line: "Host a b  c", keyword: "host", args: []string{"a", "b", "c"}},
+		{line: `IdentityFile "/keys/my key" /keys/other`, keyword: "identityfile", args: []string{"/keys/my key", "/keys/other"}},
+		{line: `IdentityFile ""`, keyword: "identityfile", args: []string{""}},
+		{line: "User deploy # comment", keyword: "user", args: []string{"deploy"}},
+		{line: `IdentityFile "/keys/my key`, err: true},
+	}
+
+	for _, test := range tests {
+		keyword, args, err := splitSSHConfigLine(test.line)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: no error", test.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.line, err)
+			continue
+		}
+		if keyword != test.keyword {
+			t.Errorf("%q: keyword %q, %q expected", test.line, keyword, test.keyword)
+		}
+		if len(args) != len(test.args) || (len(args) > 0 && !reflect.DeepEqual(args, test.args)) {
+			t.Errorf("%q: arguments %q, %q expected", test.line, args, test.args)
+		}
+	}
+}
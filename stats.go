@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// counters shared by all proxied connections,
+// only accessed through sync/atomic
+var (
+	// last proxied connection ID
+	connIDs uint64
+	// streams torn down because of an error
+	streamErrors uint64
+	// streams being proxied, and since start
+	activeStreams int64
+	totalStreams  uint64
+	// bytes sent to the remote Docker endpoint, and received from it
+	bytesSent     uint64
+	bytesReceived uint64
+)
+
+// countingWriter adds the number of bytes written to a counter
+type countingWriter struct {
+	io.Writer
+	count *uint64
+}
+
+func (w countingWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	atomic.AddUint64(w.count, uint64(n))
+	return n, err
+}
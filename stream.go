@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+var (
+	errIdleTimeout = errors.New("idle timeout")
+)
+
+// closeWriter is implemented by connections that support half-close:
+// ssh channels, *net.TCPConn, *net.UnixConn and *tls.Conn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipe copies data between a client connection and a remote stream
+// until both directions are done, or one of them fails.
+// When one side is done sending, the write half of the other side is
+// closed, so hijacked streams (docker attach, exec...) see EOF while
+// data keeps flowing in the other direction.
+// With a non zero idleTimeout, the stream is closed when no data went
+// through it, in either direction, for that long.
+func pipe(log *logger, conn, remote net.Conn, idleTimeout time.Duration) error {
+	if idleTimeout > 0 {
+		conn = newIdleConn(conn, idleTimeout)
+	}
+
+	toRemote := make(chan error, 1)
+	toClient := make(chan error, 1)
+	go func() {
+		toRemote <- halfPipe(remote, conn, &bytesSent)
+	}()
+	go func() {
+		toClient <- halfPipe(conn, remote, &bytesReceived)
+	}()
+
+	var err error
+	clientDone := false
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-toRemote:
+			if e == nil {
+				log.debug("client done sending")
+				clientDone = true
+				continue
+			}
+			if err == nil {
+				err = fmt.Errorf("client to remote: %s", e)
+			}
+		case e := <-toClient:
+			if e == nil {
+				log.debug("remote done sending")
+				continue
+			}
+			if err == nil && clientDone {
+				// client closed the connection without waiting for
+				// the end of the response (docker logs -f, ctrl-c...)
+				log.debug("client went away:", e)
+			} else if err == nil {
+				err = fmt.Errorf("remote to client: %s", e)
+			}
+		}
+		// unblock the other direction, errors it
+		// returns because of that are ignored
+		conn.Close()
+		remote.Close()
+	}
+
+	conn.Close()
+	remote.Close()
+
+	return err
+}
+
+// halfPipe copies from src to dst until src is done sending,
+// then closes dst's write half. Bytes copied are added to count.
+func halfPipe(dst, src net.Conn, count *uint64) error {
+	_, err := io.Copy(countingWriter{Writer: dst, count: count}, src)
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return errIdleTimeout
+		}
+		return err
+	}
+	cw, ok := dst.(closeWriter)
+	if !ok {
+		return fmt.Errorf("half-close not supported (%T)", dst)
+	}
+	return cw.CloseWrite()
+}
+
+// idleConn pushes its deadline back each time data is read or
+// written, so it only expires when the connection is idle in
+// both directions
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func newIdleConn(conn net.Conn, timeout time.Duration) *idleConn {
+	conn.SetDeadline(time.Now().Add(timeout))
+	return &idleConn{Conn: conn, timeout: timeout}
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	return n, err
+}
+
+func (c *idleConn) CloseWrite() error {
+	cw, ok := c.Conn.(closeWriter)
+	if !ok {
+		return fmt.Errorf("half-close not supported (%T)", c.Conn)
+	}
+	return cw.CloseWrite()
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// delays between reconnection attempts, doubled after each failure
+	reconnectMinDelay = time.Second
+	reconnectMaxDelay = time.Minute
+	// how long a new proxied connection waits for the
+	// ssh connection to be re-established
+	reconnectWaitTimeout = 30 * time.Second
+	// TCP connection timeout, for the Docker host and jump hosts
+	sshConnectTimeout = 30 * time.Second
+	// keepalive requests detect dead connections that
+	// would otherwise never return an error (laptop sleep...)
+	defaultServerAliveInterval = 30 * time.Second
+	defaultServerAliveCountMax = 3
+)
+
+// ssh connection states
+const (
+	connStateConnected = "connected"
+	// keepalive requests are not answered
+	connStateUnresponsive = "unresponsive"
+	connStateReconnecting = "reconnecting"
+	connStateClosed       = "closed"
+)
+
+var (
+	errSupervisorClosed = errors.New("ssh connection closed")
+	errReconnecting     = errors.New("ssh connection lost, still trying to reconnect")
+)
+
+// sshSupervisor maintains an ssh connection, establishing
+// a new one whenever the transport drops
+type sshSupervisor struct {
+	dial func() (*sshHost, error)
+	// keepalive requests are sent every aliveInterval (0 disables them),
+	// connection is considered dead after aliveCountMax missed replies
+	aliveInterval time.Duration
+	aliveCountMax int
+
+	mu     sync.Mutex
+	client *sshHost
+	// ready is closed when client can be used
+	ready  chan struct{}
+	closed bool
+	state  string
+	// number of consecutive keepalive requests without reply
+	missedKeepAlives int
+}
+
+// newSSHSupervisor establishes a first connection using dial,
+// then supervises it in the background
+func newSSHSupervisor(dial func() (*sshHost, error), aliveInterval time.Duration, aliveCountMax int) (*sshSupervisor, error) {
+	client, err := dial()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &sshSupervisor{
+		dial:          dial,
+		aliveInterval: aliveInterval,
+		aliveCountMax: aliveCountMax,
+		client:        client,
+		ready:         make(chan struct{}),
+		state:         connStateConnected,
+	}
+	close(s.ready)
+
+	go s.supervise(client)
+
+	return s, nil
+}
+
+// Client returns the current ssh client. If the connection is being
+// re-established, it waits for it for a limited amount of time.
+func (s *sshSupervisor) Client() (*sshHost, error) {
+	s.mu.Lock()
+	ready := s.ready
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+	case <-time.After(reconnectWaitTimeout):
+		return nil, errReconnecting
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, errSupervisorClosed
+	}
+	return s.client, nil
+}
+
+// State returns the connection state and the number of
+// consecutive keepalive requests that didn't get a reply
+func (s *sshSupervisor) State() (string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state, s.missedKeepAlives
+}
+
+func (s *sshSupervisor) setState(state string, missedKeepAlives int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.state = state
+	s.missedKeepAlives = missedKeepAlives
+}
+
+// Close closes the ssh connection and stops reconnecting
+func (s *sshSupervisor) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.state = connStateClosed
+	select {
+	case <-s.ready:
+	default:
+		// unblock callers waiting for a connection
+		close(s.ready)
+	}
+	return s.client.Close()
+}
+
+// supervise waits for client's transport to fail,
+// then reconnects with exponential backoff
+func (s *sshSupervisor) supervise(client *sshHost) {
+	for {
+		stopKeepAlive := make(chan struct{})
+		if s.aliveInterval > 0 {
+			go s.keepAlive(client, stopKeepAlive)
+		}
+
+		err := client.Wait()
+		close(stopKeepAlive)
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return
+		}
+		s.ready = make(chan struct{})
+		s.state = connStateReconnecting
+		s.mu.Unlock()
+
+		printWarn("ssh connection lost:", err)
+
+		client = s.reconnect()
+		if client == nil {
+			return
+		}
+	}
+}
+
+// reconnect dials until it succeeds or the supervisor gets closed,
+// in which case it returns nil
+func (s *sshSupervisor) reconnect() *sshHost {
+	delay := reconnectMinDelay
+	for {
+		printDebug("reconnecting in", delay)
+		time.Sleep(delay)
+
+		s.mu.Lock()
+		closed := s.closed
+		s.mu.Unlock()
+		if closed {
+			return nil
+		}
+
+		client, err := s.dial()
+		if err != nil {
+			printWarn("can't reconnect:", err)
+			delay *= 2
+			if delay > reconnectMaxDelay {
+				delay = reconnectMaxDelay
+			}
+			continue
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			client.Close()
+			return nil
+		}
+		s.client = client
+		s.state = connStateConnected
+		s.missedKeepAlives = 0
+		close(s.ready)
+		s.mu.Unlock()
+
+		print("ssh connection re-established")
+		return client
+	}
+}
+
+// keepAlive sends a keepalive request every aliveInterval, and
+// closes client when aliveCountMax requests in a row didn't get
+// a reply, which makes the supervisor reconnect.
+// Like OpenSSH, any reply (even a failure) means the server is alive.
+func (s *sshSupervisor) keepAlive(client *sshHost, stop chan struct{}) {
+	ticker := time.NewTicker(s.aliveInterval)
+	defer ticker.Stop()
+
+	replies := make(chan error, 1)
+	pending := false
+	missed := 0
+
+	for {
+		select {
+		case <-stop:
+			return
+		case err := <-replies:
+			pending = false
+			if err != nil {
+				// transport error, client.Wait returns as well
+				printDebug("keepalive failed:", err)
+				return
+			}
+			if missed > 0 {
+				print("ssh connection responsive again")
+			}
+			missed = 0
+			s.setState(connStateConnected, 0)
+		case <-ticker.C:
+			if pending {
+				missed++
+				s.setState(connStateUnresponsive, missed)
+				printWarn(fmt.Sprintf("no reply to keepalive (%d/%d)", missed, s.aliveCountMax))
+				if missed >= s.aliveCountMax {
+					printWarn("ssh connection considered dead")
+					client.Close()
+					return
+				}
+				continue
+			}
+			pending = true
+			go func() {
+				_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+				replies <- err
+			}()
+		}
+	}
+}
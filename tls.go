@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/user"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// proxy mode default listen address when TLS is enabled
+	defaultTLSListenAddr = "tcp://127.0.0.1:2376"
+	// clients that don't complete the handshake are dropped
+	tlsHandshakeTimeout = 10 * time.Second
+)
+
+// defaultCertsDir returns the directory where certificates are
+// generated by "certs generate", and read from by default
+func defaultCertsDir() (string, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(usr.HomeDir, ".docker-tunnel", "certs"), nil
+}
+
+// serverTLSConfig returns a TLS configuration using server certificate
+// and key. When verify is true, clients have to present a certificate
+// signed by the CA found at caPath (mutual TLS).
+// Empty paths are replaced by files from the default certs directory.
+func serverTLSConfig(caPath, certPath, keyPath string, verify bool) (*tls.Config, error) {
+	if caPath == "" || certPath == "" || keyPath == "" {
+		certsDir, err := defaultCertsDir()
+		if err != nil {
+			return nil, err
+		}
+		if caPath == "" {
+			caPath = filepath.Join(certsDir, caCertFile)
+		}
+		if certPath == "" {
+			certPath = filepath.Join(certsDir, serverCertFile)
+		}
+		if keyPath == "" {
+			keyPath = filepath.Join(certsDir, serverKeyFile)
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("can't load server certificate: %s (certificates can be created with \"docker-tunnel certs generate\")", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if verify {
+		caPEM, err := ioutil.ReadFile(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("can't read CA certificate: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("can't parse CA certificate: " + caPath)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// tlsListener wraps tcp listeners to serve TLS, unix
+// socket listeners are returned unchanged
+func tlsListener(ln net.Listener, config *tls.Config) net.Listener {
+	if _, ok := ln.(*net.TCPListener); !ok {
+		return ln
+	}
+	return tls.NewListener(ln, config)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aduermael/crypto/ssh"
+)
+
+var (
+	reOpenSSHVersion = regexp.MustCompile(`OpenSSH_([0-9]+)\.([0-9]+)`)
+
+	errDeadlineNotSupported = errors.New("deadlines not supported on exec bridge")
+)
+
+// ways to reach the remote Docker endpoint (--transport)
+const (
+	// channels when possible, exec bridge otherwise
+	transportAuto = "auto"
+	// direct-tcpip and direct-streamlocal@openssh.com channels
+	transportDirect = "direct"
+	// exec bridges: remote command's stdin and stdout
+	// are connected to the Docker endpoint
+	transportDialStdio = "dial-stdio"
+	transportSocat     = "socat"
+)
+
+// detectBridgeScript prints the exec bridge that can be used.
+// It must not contain single quotes.
+const detectBridgeScript = `
+if command -v docker >/dev/null 2>&1; then
+	echo dial-stdio
+elif command -v socat >/dev/null 2>&1; then
+	echo socat
+fi
+`
+
+// checkTransport returns an error if mode isn't a valid --transport value
+func checkTransport(mode string) error {
+	switch mode {
+	case transportAuto, transportDirect, transportDialStdio, transportSocat:
+		return nil
+	}
+	return fmt.Errorf("invalid transport: %s (auto, direct, dial-stdio or socat expected)", mode)
+}
+
+// support of direct-streamlocal@openssh.com channels,
+// used to reach unix sockets on the remote host
+const (
+	streamLocalUnknown = iota
+	streamLocalSupported
+	streamLocalUnsupported
+)
+
+// sshHost is an ssh connection to the Docker host, along with what
+// the server is known to support. Capabilities are detected once,
+// when connecting, and refined when channels get rejected.
+type sshHost struct {
+	*ssh.Client
+	// user@host:port of the Docker host (not of jump hosts)
+	destination string
+
+	mu          sync.Mutex
+	streamLocal int
+	// exec bridge used when channels can't be, detected on first use
+	bridge string
+}
+
+// newSSHHost detects server capabilities from its version:
+// OpenSSH supports streamlocal channels since 6.7, other servers
+// (Dropbear...) may support them as well and are given a try
+func newSSHHost(client *ssh.Client) *sshHost {
+	h := &sshHost{Client: client, streamLocal: streamLocalUnknown}
+
+	serverVersion := string(client.ServerVersion())
+	if match := reOpenSSHVersion.FindStringSubmatch(serverVersion); match != nil {
+		major, _ := strconv.Atoi(match[1])
+		minor, _ := strconv.Atoi(match[2])
+		if major > 6 || (major == 6 && minor >= 7) {
+			h.streamLocal = streamLocalSupported
+		} else {
+			h.streamLocal = streamLocalUnsupported
+		}
+	}
+
+	printDebug("server version:", serverVersion)
+
+	return h
+}
+
+// dialDocker opens a stream to the remote Docker endpoint, using the
+// transport selected with --transport. In auto mode, direct-tcpip and
+// streamlocal channels are used when possible, and an exec bridge
+// (docker system dial-stdio or socat) otherwise.
+func (h *sshHost) dialDocker(log *logger, network, addr string) (net.Conn, error) {
+	switch transportMode {
+	case transportDirect:
+		return h.Dial(network, addr)
+	case transportDialStdio, transportSocat:
+		return h.dialExec(log, bridgeCommand(transportMode, network, addr))
+	}
+
+	h.mu.Lock()
+	streamLocal := h.streamLocal
+	h.mu.Unlock()
+
+	if network != "unix" || streamLocal != streamLocalUnsupported {
+		conn, err := h.Dial(network, addr)
+		if err == nil || network != "unix" {
+			return conn, err
+		}
+		if !streamLocalRejected(err) {
+			return nil, err
+		}
+		// not implemented by the server, or disabled
+		// (AllowStreamLocalForwarding no)
+		log.debug("streamlocal channel rejected, using exec bridge:", err)
+		h.mu.Lock()
+		h.streamLocal = streamLocalUnsupported
+		h.mu.Unlock()
+	}
+
+	bridge, err := h.detectBridge(log)
+	if err != nil {
+		return nil, err
+	}
+	return h.dialExec(log, bridgeCommand(bridge, network, addr))
+}
+
+// detectBridge returns the exec bridge that can be used on the remote
+// host: dial-stdio if the docker CLI is installed, socat otherwise.
+// The result is remembered for the connection.
+func (h *sshHost) detectBridge(log *logger) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.bridge != "" {
+		return h.bridge, nil
+	}
+
+	session, err := h.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	output, err := session.Output("sh -c '" + detectBridgeScript + "'")
+	if err != nil {
+		return "", fmt.Errorf("can't detect exec bridge: %s", err)
+	}
+	bridge := strings.TrimSpace(string(output))
+	if bridge != transportDialStdio && bridge != transportSocat {
+		return "", errors.New("streamlocal forwarding isn't available and neither docker nor socat can be found on remote host")
+	}
+
+	log.debug("using exec bridge:", bridge)
+	h.bridge = bridge
+	return bridge, nil
+}
+
+// bridgeCommand returns the remote command used by an exec bridge
+// to reach the Docker endpoint
+func bridgeCommand(bridge, network, addr string) string {
+	if bridge == transportDialStdio {
+		return "docker -H " + shellQuote(network+"://"+addr) + " system dial-stdio"
+	}
+	if network == "unix" {
+		return "socat - UNIX-CONNECT:" + shellQuote(addr)
+	}
+	return "socat - TCP:" + shellQuote(addr)
+}
+
+// streamLocalRejected returns true if err means streamlocal channels
+// can't be used at all, and not only that the socket can't be reached
+func streamLocalRejected(err error) bool {
+	openErr, ok := err.(*ssh.OpenChannelError)
+	if !ok {
+		return false
+	}
+	return openErr.Reason == ssh.Prohibited || openErr.Reason == ssh.UnknownChannelType
+}
+
+// dialExec runs command in a new session, and returns
+// a connection reading its stdout and writing its stdin
+func (h *sshHost) dialExec(log *logger, command string) (net.Conn, error) {
+	session, err := h.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	session.Stderr = &remoteStderr{command: command, log: log}
+	if err := session.Start(command); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("can't start %q on remote host: %s", command, err)
+	}
+	log.debug("exec bridge:", command)
+
+	return &execConn{
+		session:    session,
+		stdin:      stdin,
+		stdout:     stdout,
+		localAddr:  h.LocalAddr(),
+		remoteAddr: h.RemoteAddr(),
+	}, nil
+}
+
+// execConn is a net.Conn over the stdin and stdout of a remote command
+type execConn struct {
+	session    *ssh.Session
+	stdin      io.WriteCloser
+	stdout     io.Reader
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+func (c *execConn) Read(b []byte) (int, error) {
+	return c.stdout.Read(b)
+}
+
+func (c *execConn) Write(b []byte) (int, error) {
+	return c.stdin.Write(b)
+}
+
+// CloseWrite closes the command's stdin
+func (c *execConn) CloseWrite() error {
+	return c.stdin.Close()
+}
+
+func (c *execConn) Close() error {
+	return c.session.Close()
+}
+
+func (c *execConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *execConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *execConn) SetDeadline(t time.Time) error {
+	return errDeadlineNotSupported
+}
+
+func (c *execConn) SetReadDeadline(t time.Time) error {
+	return errDeadlineNotSupported
+}
+
+func (c *execConn) SetWriteDeadline(t time.Time) error {
+	return errDeadlineNotSupported
+}
+
+// remoteStderr logs what a remote command writes to stderr
+type remoteStderr struct {
+	command string
+	log     *logger
+}
+
+func (s *remoteStderr) Write(b []byte) (int, error) {
+	s.log.warn(s.command+":", strings.TrimSpace(string(b)))
+	return len(b), nil
+}
+
+// shellQuote quotes s to be used as a single
+// argument in a POSIX shell command line
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}